@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Circuit breaker states, also the values of the db_circuit_breaker_state gauge.
+const (
+	breakerClosed   = 0
+	breakerHalfOpen = 1
+	breakerOpen     = 2
+)
+
+// dbBreaker trips after DB_BREAKER_FAILURES consecutive failed or timed-out
+// queries on the primary and fast-fails API requests for DB_BREAKER_COOLDOWN,
+// so a struggling database isn't buried under queued work. After the cooldown
+// one request at a time is let through as a probe; the first query outcome
+// closes the breaker again or re-opens it. A nil *dbBreaker is valid and
+// never trips.
+//
+// It observes queries as a pgx tracer, so every repo call is counted without
+// each one having to report in.
+type dbBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     int
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newDBBreaker(threshold int, cooldown time.Duration) *dbBreaker {
+	if threshold <= 0 || cooldown <= 0 {
+		return nil
+	}
+	dbBreakerState.Set(breakerClosed)
+	return &dbBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may proceed. probe is true for the single
+// request admitted while half-open; it must be passed to done.
+func (b *dbBreaker) allow() (ok, probe bool, retryAfter time.Duration) {
+	if b == nil {
+		return true, false, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if wait := time.Until(b.openUntil); wait > 0 {
+			return false, false, wait
+		}
+		b.setState(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false, false, time.Second
+		}
+		b.probing = true
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// done frees the probe slot of a request that finished without any query
+// deciding the breaker's state, so the next request can probe instead.
+func (b *dbBreaker) done(probe bool) {
+	if b == nil || !probe {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+func (b *dbBreaker) record(err error) {
+	if b == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := isTransientDBError(err) || errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			log.Println("dbBreaker: probe succeeded, closing")
+			b.probing = false
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		log.Printf("dbBreaker: opening for %s after %d consecutive failures: %v", b.cooldown, b.failures, err)
+		b.probing = false
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.setState(breakerOpen)
+	}
+}
+
+// stateName reports the breaker state for diagnostics; "disabled" when it
+// isn't configured.
+func (b *dbBreaker) stateName() string {
+	if b == nil {
+		return "disabled"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+func (b *dbBreaker) setState(state int) {
+	b.state = state
+	dbBreakerState.Set(float64(state))
+}
+
+// TraceQueryStart implements pgx.QueryTracer.
+func (b *dbBreaker) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	return ctx
+}
+
+// TraceQueryEnd implements pgx.QueryTracer.
+func (b *dbBreaker) TraceQueryEnd(_ context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	b.record(data.Err)
+}
+
+// circuitBreaker answers 503 service_unavailable while the breaker is open.
+func (s *server) circuitBreaker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, probe, retryAfter := s.breaker.allow()
+		if !ok {
+			log.Printf("circuit breaker open: rejected method=%s path=%s remote=%s", r.Method, r.URL.Path, r.RemoteAddr)
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "service_unavailable"})
+			return
+		}
+		defer s.breaker.done(probe)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// registrationCache is a size-bounded LRU of registrations with a per-entry
+// TTL. A nil *registrationCache is valid and caches nothing.
+type registrationCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	ll    *list.List
+	items map[uuid.UUID]*list.Element
+}
+
+type registrationCacheEntry struct {
+	id        uuid.UUID
+	reg       Registration
+	expiresAt time.Time
+}
+
+func newRegistrationCache(size int, ttl time.Duration) *registrationCache {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	return &registrationCache{
+		size:  size,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[uuid.UUID]*list.Element, size),
+	}
+}
+
+func (c *registrationCache) get(id uuid.UUID) (Registration, bool) {
+	if c == nil {
+		return Registration{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[id]
+	if !ok {
+		registrationCacheRequests.WithLabelValues("miss").Inc()
+		return Registration{}, false
+	}
+
+	entry := el.Value.(*registrationCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, id)
+		registrationCacheRequests.WithLabelValues("miss").Inc()
+		return Registration{}, false
+	}
+
+	c.ll.MoveToFront(el)
+	registrationCacheRequests.WithLabelValues("hit").Inc()
+	return entry.reg, true
+}
+
+func (c *registrationCache) put(reg Registration) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(c.ttl)
+	if el, ok := c.items[reg.RegistrationID]; ok {
+		entry := el.Value.(*registrationCacheEntry)
+		entry.reg = reg
+		entry.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[reg.RegistrationID] = c.ll.PushFront(&registrationCacheEntry{
+		id:        reg.RegistrationID,
+		reg:       reg,
+		expiresAt: expiresAt,
+	})
+
+	if c.ll.Len() > c.size {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*registrationCacheEntry).id)
+	}
+}
+
+// invalidate drops a registration; call it after any write to that row.
+func (c *registrationCache) invalidate(id uuid.UUID) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[id]; ok {
+		c.ll.Remove(el)
+		delete(c.items, id)
+	}
+}
+
+// usersStaleCache keeps the last good users list per page so getUsers can
+// answer from it while the database is briefly unreachable. A nil
+// *usersStaleCache is valid and caches nothing.
+type usersStaleCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[listUsersParams]usersSnapshot
+}
+
+type usersSnapshot struct {
+	users   []User
+	total   int
+	savedAt time.Time
+}
+
+// usersStaleMaxPages bounds how many distinct pages are remembered.
+const usersStaleMaxPages = 64
+
+func newUsersStaleCache(ttl time.Duration) *usersStaleCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &usersStaleCache{ttl: ttl, entries: make(map[listUsersParams]usersSnapshot)}
+}
+
+func (c *usersStaleCache) get(p listUsersParams) ([]User, int, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	snap, ok := c.entries[p]
+	if !ok || time.Since(snap.savedAt) > c.ttl {
+		return nil, 0, false
+	}
+	return slices.Clone(snap.users), snap.total, true
+}
+
+func (c *usersStaleCache) put(p listUsersParams, users []User, total int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[p]; !ok && len(c.entries) >= usersStaleMaxPages {
+		for k, snap := range c.entries {
+			if now.Sub(snap.savedAt) > c.ttl {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= usersStaleMaxPages {
+			return
+		}
+	}
+	c.entries[p] = usersSnapshot{users: slices.Clone(users), total: total, savedAt: now}
+}
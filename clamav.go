@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const clamavChunkSize = 64 << 10
+
+// clamavScan streams data to a clamd daemon using the INSTREAM command and
+// returns the matched signature when the daemon reports the data as infected.
+func clamavScan(ctx context.Context, addr string, timeout time.Duration, data []byte) (infected bool, signature string, err error) {
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return false, "", err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return false, "", err
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, "", err
+	}
+
+	var size [4]byte
+	for off := 0; off < len(data); off += clamavChunkSize {
+		chunk := data[off:min(off+clamavChunkSize, len(data))]
+		binary.BigEndian.PutUint32(size[:], uint32(len(chunk)))
+		if _, err := conn.Write(size[:]); err != nil {
+			return false, "", err
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return false, "", err
+		}
+	}
+
+	// a zero-length chunk terminates the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	if _, err := conn.Write(size[:]); err != nil {
+		return false, "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return false, "", err
+	}
+	result := strings.TrimSpace(string(bytes.TrimSuffix(reply, []byte{0})))
+
+	// replies look like "stream: OK" or "stream: <signature> FOUND"
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return false, "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return true, strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return false, "", fmt.Errorf("unexpected clamd reply: %q", result)
+	}
+}
+
+// scanUpload runs the uploaded bytes through ClamAV when CLAMAV_ADDR is set.
+// Rejections are returned as *uploadError so handlers can use writeUploadError.
+func (s *server) scanUpload(ctx context.Context, data []byte) error {
+	if s.cfg.ClamAVAddr == "" || !s.isEnabled(flagUploadScan) {
+		return nil
+	}
+
+	start := time.Now()
+	infected, signature, err := clamavScan(ctx, s.cfg.ClamAVAddr, s.cfg.ClamAVTimeout, data)
+	if err != nil {
+		if s.cfg.ClamAVFailOpen {
+			log.Printf("scanUpload: scan failed, accepting upload (fail open): %v", err)
+			return nil
+		}
+		log.Printf("scanUpload: scan failed, rejecting upload (fail closed): %v", err)
+		return &uploadError{status: http.StatusServiceUnavailable, code: "scan_unavailable"}
+	}
+
+	if infected {
+		log.Printf("scanUpload: rejected infected upload signature=%s", signature)
+		return &uploadError{status: http.StatusUnprocessableEntity, code: "file_rejected_malware"}
+	}
+
+	log.Printf("scanUpload: clean %d bytes in %s", len(data), time.Since(start).String())
+	return nil
+}
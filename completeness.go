@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// completenessItem is one required document in a registration's checklist.
+// RequiredCount is applicant_count for PER_APPLICANT_FILE_TYPES and 1
+// otherwise; Present means that many files are uploaded.
+type completenessItem struct {
+	FileType      string      `json:"file_type"`
+	Present       bool        `json:"present"`
+	RequiredCount int         `json:"required_count"`
+	FileIDs       []uuid.UUID `json:"file_ids"`
+}
+
+type completenessReport struct {
+	RegistrationID uuid.UUID          `json:"registration_id"`
+	VisaType       *string            `json:"visa_type"`
+	Complete       bool               `json:"complete"`
+	Required       []completenessItem `json:"required"`
+	Missing        []string           `json:"missing"`
+	// PassportsMissing is how many more passports a group registration needs
+	// when passports are required once per applicant.
+	PassportsMissing int `json:"passports_missing"`
+}
+
+// registrationCompletenessHandler checks the registration's uploaded files
+// against REQUIRED_FILE_TYPES for its visa type, needing one file per applicant
+// for PER_APPLICANT_FILE_TYPES. Soft-deleted files don't count.
+func (s *server) registrationCompletenessHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("registrationCompleteness start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, OPTIONS")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	registration, err := s.getRegistrationByID(ctx, registrationID)
+	if err != nil {
+		if errors.Is(err, errRegistrationNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+			return
+		}
+		writeServerError(w, r, "registrationCompleteness fetch", err)
+		return
+	}
+
+	files, err := s.listRegistrationFiles(ctx, registrationID, false)
+	if err != nil {
+		writeServerError(w, r, "registrationCompleteness files", err)
+		return
+	}
+
+	var required []string
+	if registration.VisaType != nil {
+		required = s.cfg.RequiredFileTypes[strings.ToLower(*registration.VisaType)]
+	}
+
+	byType := make(map[string][]uuid.UUID)
+	for _, f := range files {
+		t := strings.ToLower(f.FileType)
+		byType[t] = append(byType[t], f.FileID)
+	}
+
+	report := completenessReport{
+		RegistrationID: registrationID,
+		VisaType:       registration.VisaType,
+		Required:       make([]completenessItem, 0, len(required)),
+		Missing:        make([]string, 0),
+	}
+	for _, fileType := range required {
+		ids := byType[fileType]
+		if ids == nil {
+			ids = make([]uuid.UUID, 0)
+		}
+		want := 1
+		if slices.Contains(s.cfg.PerApplicantFileTypes, fileType) {
+			want = max(registration.ApplicantCount, 1)
+		}
+		present := len(ids) >= want
+		if !present {
+			report.Missing = append(report.Missing, fileType)
+		}
+		if fileType == "passport" {
+			report.PassportsMissing = max(want-len(ids), 0)
+		}
+		report.Required = append(report.Required, completenessItem{FileType: fileType, Present: present, RequiredCount: want, FileIDs: ids})
+	}
+	report.Complete = len(report.Missing) == 0
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("registrationCompleteness encode failed: %v", err)
+	}
+}
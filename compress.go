@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+)
+
+// minCompressionSaving is the fraction a trial compression must save before
+// the compressed form is stored; below that the CPU cost on every download
+// isn't worth it.
+const minCompressionSaving = 0.10
+
+// maybeCompress gzips data for storage when it is worth it. Images and
+// archives are skipped outright; everything else is trial-compressed and kept
+// raw unless it shrinks by at least minCompressionSaving.
+func maybeCompress(data []byte, mimeType string) ([]byte, bool) {
+	if strings.HasPrefix(mimeType, "image/") || mimeType == "application/zip" || mimeType == "application/x-gzip" {
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return data, false
+	}
+	if err := zw.Close(); err != nil {
+		return data, false
+	}
+
+	if float64(buf.Len()) > float64(len(data))*(1-minCompressionSaving) {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// compressForStorage applies maybeCompress only when STORE_COMPRESSION is on.
+func (s *server) compressForStorage(data []byte, mimeType string) ([]byte, bool) {
+	if !s.cfg.StoreCompression {
+		return data, false
+	}
+	return maybeCompress(data, mimeType)
+}
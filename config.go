@@ -0,0 +1,494 @@
+package main
+
+import (
+	"compress/gzip"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type config struct {
+	// ServiceName is reported by the descriptor served at "/".
+	ServiceName string
+
+	ReadOnly   bool
+	ReplicaURL string
+
+	// RegistrationCacheSize of 0 disables the registration detail cache.
+	RegistrationCacheSize int
+	RegistrationCacheTTL  time.Duration
+
+	// RegistrationStorageQuota caps the summed file_size per registration; 0 disables it.
+	RegistrationStorageQuota int64
+
+	PoolStatsInterval   time.Duration
+	PoolWarnUtilization float64
+
+	BulkRegistrationMax int
+
+	// MaxResultRows is a hard ceiling on rows any list query returns,
+	// independent of the requested limit, NDJSON streams included; 0
+	// disables it.
+	MaxResultRows int
+
+	// RegistrationArchiveAfter archives registrations in a final status once
+	// they are this old, hiding them from lists unless ?archived=true; 0
+	// disables archival.
+	RegistrationArchiveAfter time.Duration
+
+	// MaxRegistrationsPerWhatsapp caps registrations per WhatsApp number,
+	// not counting those in RegistrationLimitExemptStatuses; 0 disables it.
+	MaxRegistrationsPerWhatsapp     int
+	RegistrationLimitExemptStatuses []string
+
+	// ClamAVAddr enables upload scanning when set (host:port of clamd).
+	ClamAVAddr     string
+	ClamAVTimeout  time.Duration
+	ClamAVFailOpen bool
+
+	// RequestTimeout is the overall per-request deadline, overridable per
+	// HTTP method with REQUEST_TIMEOUT_<METHOD> (e.g. REQUEST_TIMEOUT_POST).
+	RequestTimeout         time.Duration
+	RequestTimeoutByMethod map[string]time.Duration
+
+	// DownloadFetchTimeout bounds loading a file or CV from the database;
+	// DownloadTransferTimeout separately bounds sending it to the client,
+	// counted from when the body starts.
+	DownloadFetchTimeout    time.Duration
+	DownloadTransferTimeout time.Duration
+
+	// DefaultSortOrder ("asc" or "desc") applies when a list request gives no
+	// ?order=. Registrations sorted by created_at stay newest first.
+	DefaultSortOrder string
+
+	// VisaTypes is the allowlist for registration visa_type (lowercase).
+	VisaTypes []string
+
+	// RequiredFileTypes maps a visa_type to the file_types a registration of
+	// that type must have uploaded; visa types not listed require nothing.
+	RequiredFileTypes map[string][]string
+	// PerApplicantFileTypes are required file types needed once per
+	// applicant (applicant_count) rather than once per registration.
+	PerApplicantFileTypes []string
+
+	// FileTypeMimeTypes lists the detected MIME types accepted for each
+	// registration file_type; file types not listed accept anything.
+	FileTypeMimeTypes map[string][]string
+
+	// FileRetention is how long files of each file_type are kept before the
+	// sweeper deletes them; types not listed are kept indefinitely.
+	FileRetention map[string]time.Duration
+
+	// InlineFileMaxBytes caps downloads served base64-encoded in JSON to
+	// clients that ask for application/json; larger files get 413.
+	InlineFileMaxBytes int64
+
+	// StoreCompression gzips file and CV blobs at rest when it saves space.
+	StoreCompression bool
+
+	// BasePath mounts the API under a prefix such as "/api/v1" (no trailing slash).
+	BasePath string
+
+	// MultipartMemory is how much of a multipart upload is held in memory;
+	// the rest spills to a temp file, keeping heap use flat under load.
+	MultipartMemory int64
+
+	// MaxConcurrentUploads of 0 disables the upload limit.
+	MaxConcurrentUploads int
+	UploadSlotWait       time.Duration
+
+	// UploadAllowedOrigins restricts uploads to requests whose Origin (or
+	// Referer) is listed; empty disables the check. In lenient mode requests
+	// carrying neither header are let through, in strict mode they are not.
+	UploadAllowedOrigins []string
+	UploadOriginStrict   bool
+
+	// APIKey guards admin endpoints; when empty they are disabled.
+	APIKey string
+
+	// DownloadAuth decides who may download registration files and user CVs:
+	// "off" lets anyone with the URL, "signed" needs the API key or a signed
+	// URL and "api_key" needs the API key. Signed URLs are minted with
+	// DownloadSigningKey and stay valid for DownloadURLTTL.
+	DownloadAuth       string
+	DownloadSigningKey string
+	DownloadURLTTL     time.Duration
+
+	// Photo* bound the pixel size of file_type=photo uploads; a max of 0 means unbounded.
+	PhotoMinWidth  int
+	PhotoMinHeight int
+	PhotoMaxWidth  int
+	PhotoMaxHeight int
+
+	// RateLimitRPS is the per-client refill rate of the API rate limiter; 0 disables it.
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// TrustedProxyHops is how many reverse proxies (Render's router is one)
+	// append to X-Forwarded-For in front of the service. The rate limiter
+	// keys on the address the outermost of them saw; 0 uses the connection's
+	// address and ignores the header.
+	TrustedProxyHops int
+
+	// CORSAllowedOrigins lists origins allowed cross-origin access; empty disables CORS.
+	CORSAllowedOrigins []string
+	CORSExposeHeaders  []string
+	CORSMaxAge         time.Duration
+
+	// UsersStaleTTL lets GET /users fall back to the last good list for this
+	// long when the database fails; 0 disables the fallback.
+	UsersStaleTTL time.Duration
+
+	// DBBreakerFailures consecutive failed or timed-out queries open the DB
+	// circuit breaker for DBBreakerCooldown; 0 disables it.
+	DBBreakerFailures int
+	DBBreakerCooldown time.Duration
+
+	// UploadSessionTTL is how long a resumable upload may sit idle before it
+	// is discarded.
+	UploadSessionTTL time.Duration
+
+	// WebhookURL receives registration events when set. Each delivery attempt
+	// is bounded by WebhookTimeout; WebhookMaxAttempts attempts are made,
+	// waiting WebhookRetryBackoff before the first retry and doubling after.
+	WebhookURL          string
+	WebhookTimeout      time.Duration
+	WebhookMaxAttempts  int
+	WebhookRetryBackoff time.Duration
+
+	// FeatureFlagRefresh is how often the feature_flags table is reloaded.
+	FeatureFlagRefresh time.Duration
+
+	// ShutdownDrainTimeout bounds how long shutdown waits for in-flight uploads.
+	ShutdownDrainTimeout time.Duration
+
+	// GzipLevel is the response compression level (1 fastest – 9 smallest).
+	// Higher levels cost noticeably more CPU on the small Render instance for
+	// little extra saving on JSON; 5 is a reasonable middle.
+	GzipLevel int
+
+	// MaxDecompressedBody caps how large a gzip-encoded JSON request body may
+	// grow once inflated, so a tiny zip bomb can't exhaust memory.
+	MaxDecompressedBody int64
+
+	// MaxCamelCaseBody caps a JSON request body jsonCase buffers to re-key
+	// from camelCase; larger bodies get 413.
+	MaxCamelCaseBody int64
+
+	// PprofEnabled serves net/http/pprof on PprofAddr, separate from the API port.
+	PprofEnabled bool
+	PprofAddr    string
+}
+
+func loadConfig() config {
+	return config{
+		ServiceName: envString("SERVICE_NAME", "safaraya-service"),
+
+		ReadOnly:   envBool("READ_ONLY", false),
+		ReplicaURL: strings.TrimSpace(os.Getenv("DATABASE_REPLICA_URL")),
+
+		RegistrationCacheSize: envInt("REGISTRATION_CACHE_SIZE", 256),
+		RegistrationCacheTTL:  envDuration("REGISTRATION_CACHE_TTL", 30*time.Second),
+
+		RegistrationStorageQuota: int64(envInt("REGISTRATION_STORAGE_QUOTA_BYTES", 25<<20)),
+
+		PoolStatsInterval:   envDuration("POOL_STATS_INTERVAL", 30*time.Second),
+		PoolWarnUtilization: envFloat("POOL_WARN_UTILIZATION", 0.8),
+
+		BulkRegistrationMax: envInt("BULK_REGISTRATION_MAX", 500),
+
+		MaxResultRows: envInt("MAX_RESULT_ROWS", 1000),
+
+		RegistrationArchiveAfter: envDuration("REGISTRATION_ARCHIVE_AFTER", 0),
+
+		MaxRegistrationsPerWhatsapp:     envInt("MAX_REGISTRATIONS_PER_WHATSAPP", 3),
+		RegistrationLimitExemptStatuses: envList("REGISTRATION_LIMIT_EXEMPT_STATUSES", []string{"rejected", "cancelled"}),
+
+		ClamAVAddr:     strings.TrimSpace(os.Getenv("CLAMAV_ADDR")),
+		ClamAVTimeout:  envDuration("CLAMAV_TIMEOUT", 10*time.Second),
+		ClamAVFailOpen: envBool("CLAMAV_FAIL_OPEN", false),
+
+		RequestTimeout:         envDuration("REQUEST_TIMEOUT", 15*time.Second),
+		RequestTimeoutByMethod: requestTimeoutOverrides(),
+
+		DownloadFetchTimeout:    envDuration("DOWNLOAD_FETCH_TIMEOUT", 5*time.Second),
+		DownloadTransferTimeout: envDuration("DOWNLOAD_TRANSFER_TIMEOUT", 2*time.Minute),
+
+		DefaultSortOrder: sortOrder(envString("DEFAULT_SORT_ORDER", "asc")),
+
+		VisaTypes: envList("VISA_TYPES", []string{"umrah", "hajj", "tourist", "work", "student"}),
+		RequiredFileTypes: envListMap("REQUIRED_FILE_TYPES", map[string][]string{
+			"umrah":   {"passport", "photo"},
+			"hajj":    {"passport", "photo"},
+			"tourist": {"passport", "photo"},
+			"work":    {"passport", "photo", "contract"},
+			"student": {"passport", "photo"},
+		}),
+		PerApplicantFileTypes: envList("PER_APPLICANT_FILE_TYPES", []string{"passport"}),
+
+		FileTypeMimeTypes: envListMap("FILE_TYPE_MIME_TYPES", map[string][]string{
+			"photo":    {"image/jpeg", "image/png"},
+			"passport": {"application/pdf"},
+		}),
+
+		FileRetention: envDurationMap("FILE_RETENTION"),
+
+		InlineFileMaxBytes: int64(envInt("INLINE_FILE_MAX_BYTES", 1<<20)),
+
+		StoreCompression: envBool("STORE_COMPRESSION", false),
+
+		BasePath: normalizeBasePath(os.Getenv("BASE_PATH")),
+
+		MultipartMemory: int64(envInt("MULTIPART_MEMORY_BYTES", 1<<20)),
+
+		MaxConcurrentUploads: envInt("MAX_CONCURRENT_UPLOADS", 20),
+		UploadSlotWait:       envDuration("UPLOAD_SLOT_WAIT", 2*time.Second),
+
+		UploadAllowedOrigins: envList("UPLOAD_ALLOWED_ORIGINS", nil),
+		UploadOriginStrict:   uploadOriginMode(envString("UPLOAD_ORIGIN_MODE", "lenient")) == "strict",
+
+		APIKey: strings.TrimSpace(os.Getenv("API_KEY")),
+
+		DownloadAuth:       downloadAuthMode(envString("DOWNLOAD_AUTH", "off")),
+		DownloadSigningKey: strings.TrimSpace(os.Getenv("DOWNLOAD_SIGNING_KEY")),
+		DownloadURLTTL:     envDuration("DOWNLOAD_URL_TTL", 15*time.Minute),
+
+		PhotoMinWidth:  envInt("PHOTO_MIN_WIDTH", 300),
+		PhotoMinHeight: envInt("PHOTO_MIN_HEIGHT", 400),
+		PhotoMaxWidth:  envInt("PHOTO_MAX_WIDTH", 0),
+		PhotoMaxHeight: envInt("PHOTO_MAX_HEIGHT", 0),
+
+		RateLimitRPS:   envFloat("RATE_LIMIT_RPS", 0),
+		RateLimitBurst: envInt("RATE_LIMIT_BURST", 20),
+
+		TrustedProxyHops: envInt("TRUSTED_PROXY_HOPS", 0),
+
+		CORSAllowedOrigins: envList("CORS_ALLOWED_ORIGINS", nil),
+		CORSExposeHeaders: envHeaderList("CORS_EXPOSE_HEADERS", []string{
+			"X-Total-Count", "X-Next-Cursor", "X-Request-ID",
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "Retry-After",
+			"Content-Disposition", "Deprecation", "Link", "X-Content-SHA256",
+			"Location", "Upload-Offset", "Upload-Length", "ETag",
+		}),
+		CORSMaxAge: envDuration("CORS_MAX_AGE", 10*time.Minute),
+
+		UsersStaleTTL: envDuration("USERS_STALE_CACHE_TTL", 0),
+
+		DBBreakerFailures: envInt("DB_BREAKER_FAILURES", 5),
+		DBBreakerCooldown: envDuration("DB_BREAKER_COOLDOWN", 30*time.Second),
+
+		UploadSessionTTL: envDuration("UPLOAD_SESSION_TTL", 24*time.Hour),
+
+		WebhookURL:          strings.TrimSpace(os.Getenv("WEBHOOK_URL")),
+		WebhookTimeout:      envDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+		WebhookMaxAttempts:  envInt("WEBHOOK_MAX_ATTEMPTS", 3),
+		WebhookRetryBackoff: envDuration("WEBHOOK_RETRY_BACKOFF", time.Second),
+
+		FeatureFlagRefresh: envDuration("FEATURE_FLAG_REFRESH", 30*time.Second),
+
+		ShutdownDrainTimeout: envDuration("SHUTDOWN_DRAIN_TIMEOUT", 30*time.Second),
+
+		GzipLevel:           gzipLevel(envInt("GZIP_LEVEL", 5)),
+		MaxDecompressedBody: int64(envInt("MAX_DECOMPRESSED_BODY_BYTES", 10<<20)),
+		MaxCamelCaseBody:    int64(envInt("MAX_CAMEL_CASE_BODY_BYTES", 2<<20)),
+
+		PprofEnabled: envBool("PPROF_ENABLED", false),
+		PprofAddr:    envString("PPROF_ADDR", ":6060"),
+	}
+}
+
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("config: invalid bool for %s=%q, using default %t", key, v, def)
+		return def
+	}
+	return b
+}
+
+func envInt(key string, def int) int {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("config: invalid int for %s=%q, using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("config: invalid duration for %s=%q, using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+func envFloat(key string, def float64) float64 {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		log.Printf("config: invalid float for %s=%q, using default %g", key, v, def)
+		return def
+	}
+	return f
+}
+
+func requestTimeoutOverrides() map[string]time.Duration {
+	overrides := make(map[string]time.Duration)
+	for _, method := range []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"} {
+		if d := envDuration("REQUEST_TIMEOUT_"+method, 0); d > 0 {
+			overrides[method] = d
+		}
+	}
+	return overrides
+}
+
+// envList reads a comma-separated list, lowercasing and dropping empty items.
+func envList(key string, def []string) []string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envHeaderList reads a comma-separated list of header names, keeping their case.
+func envHeaderList(key string, def []string) []string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func normalizeBasePath(p string) string {
+	p = strings.Trim(strings.TrimSpace(p), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// envListMap reads "key=item,item;key=item" (e.g.
+// "umrah=passport,photo;work=passport,photo,contract"), lowercasing keys and
+// items. A set value replaces the defaults entirely; malformed entries are
+// logged and skipped.
+func envListMap(key string, def map[string][]string) map[string][]string {
+	v := strings.TrimSpace(os.Getenv(key))
+	if v == "" {
+		return def
+	}
+	m := make(map[string][]string)
+	for _, entry := range strings.Split(v, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		k, list, ok := strings.Cut(entry, "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		if !ok || k == "" {
+			log.Printf("config: invalid entry for %s=%q, skipping", key, entry)
+			continue
+		}
+		var items []string
+		for _, item := range strings.Split(list, ",") {
+			if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+				items = append(items, item)
+			}
+		}
+		m[k] = items
+	}
+	return m
+}
+
+// envDurationMap parses "passport=2160h;visa=720h" into a lowercase-keyed map.
+func envDurationMap(key string) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, entry := range strings.Split(os.Getenv(key), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(entry, "=")
+		k = strings.ToLower(strings.TrimSpace(k))
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if !ok || k == "" || err != nil || d <= 0 {
+			log.Printf("config: invalid entry for %s=%q, skipping", key, entry)
+			continue
+		}
+		m[k] = d
+	}
+	return m
+}
+
+// gzipLevel clamps GZIP_LEVEL to the 1–9 range gzip accepts.
+func gzipLevel(level int) int {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		log.Printf("config: GZIP_LEVEL=%d out of range 1-9, using 5", level)
+		return 5
+	}
+	return level
+}
+
+// sortOrder accepts "asc" or "desc" in any case, falling back to "asc".
+func sortOrder(order string) string {
+	order = strings.ToLower(order)
+	if order != "asc" && order != "desc" {
+		log.Printf("config: DEFAULT_SORT_ORDER=%q is not asc or desc, using asc", order)
+		return "asc"
+	}
+	return order
+}
+
+func uploadOriginMode(mode string) string {
+	mode = strings.ToLower(mode)
+	if mode != "strict" && mode != "lenient" {
+		log.Printf("config: UPLOAD_ORIGIN_MODE=%q is not strict or lenient, using lenient", mode)
+		return "lenient"
+	}
+	return mode
+}
+
+func downloadAuthMode(mode string) string {
+	mode = strings.ToLower(mode)
+	switch mode {
+	case "off", "signed", "api_key":
+		return mode
+	}
+	log.Printf("config: DOWNLOAD_AUTH=%q is not off, signed or api_key, using api_key", mode)
+	return "api_key"
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// echoRedactedHeaders never appear in /debug/echo output.
+var echoRedactedHeaders = []string{"Authorization", "Cookie", "X-Api-Key"}
+
+type echoFile struct {
+	Field        string `json:"field"`
+	Filename     string `json:"filename"`
+	Size         int64  `json:"size"`
+	DeclaredType string `json:"declared_type,omitempty"`
+	DetectedType string `json:"detected_type"`
+}
+
+type echoResponse struct {
+	Method      string              `json:"method"`
+	Path        string              `json:"path"`
+	Query       map[string][]string `json:"query,omitempty"`
+	ContentType string              `json:"content_type,omitempty"`
+	Headers     map[string][]string `json:"headers"`
+	JSON        any                 `json:"json,omitempty"`
+	Fields      map[string][]string `json:"fields,omitempty"`
+	Files       []echoFile          `json:"files,omitempty"`
+}
+
+// debugEchoHandler serves POST /debug/echo for partners checking their
+// client against ours: it parses the body with the same limits and decoding
+// the real upload and JSON handlers use and reports what it saw. File
+// contents are never echoed, only their size and type.
+func (s *server) debugEchoHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("debugEcho start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		writeOptions(w, "POST, OPTIONS")
+		return
+	default:
+		writeMethodNotAllowed(w, "POST, OPTIONS")
+		return
+	}
+	if !s.requireAPIKey(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := echoResponse{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Query:       r.URL.Query(),
+		ContentType: r.Header.Get("Content-Type"),
+		Headers:     make(map[string][]string, len(r.Header)),
+	}
+	for name, values := range r.Header {
+		if slices.Contains(echoRedactedHeaders, name) {
+			values = []string{"[redacted]"}
+		}
+		resp.Headers[name] = values
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.ContentType)
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		defer removeUploadTempFiles(r)
+		if err := s.parseUploadForm(w, r, maxUploadSize); err != nil {
+			log.Printf("debugEcho parse form failed: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form", "detail": err.Error()})
+			return
+		}
+		resp.Fields = r.MultipartForm.Value
+		for field, headers := range r.MultipartForm.File {
+			for _, fh := range headers {
+				resp.Files = append(resp.Files, echoFile{
+					Field:        field,
+					Filename:     fh.Filename,
+					Size:         fh.Size,
+					DeclaredType: fh.Header.Get("Content-Type"),
+					DetectedType: detectPartType(r.FormValue("file_type"), fh),
+				})
+			}
+		}
+	default:
+		var body any
+		if !decodeJSONBody(w, r, "debugEcho", &body) {
+			return
+		}
+		resp.JSON = body
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("debugEcho encode failed: %v", err)
+	}
+}
+
+// detectPartType resolves an uploaded part's type as the upload handlers
+// would store it.
+func detectPartType(fileType string, fh *multipart.FileHeader) string {
+	f, err := fh.Open()
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	return storedMimeType(fileType, sniffMimeType(head[:n]))
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+var registrationExportHeader = []any{
+	"Registration ID", "Full Name", "Job Title", "Address", "WhatsApp", "Note",
+	"Applicants", "Visa Type", "Status", "Created At (UTC)", "Updated At (UTC)",
+}
+
+func (s *server) exportRegistrationsXLSXHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("exportRegistrationsXLSX start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, OPTIONS")
+		return
+	}
+
+	filter, code := parseRegistrationFilter(r)
+	if code != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": code})
+		return
+	}
+
+	f := excelize.NewFile()
+	defer f.Close()
+
+	const sheet = "Registrations"
+	if err := f.SetSheetName("Sheet1", sheet); err != nil {
+		writeServerError(w, r, "exportRegistrationsXLSX sheet", err)
+		return
+	}
+
+	sw, err := f.NewStreamWriter(sheet)
+	if err != nil {
+		writeServerError(w, r, "exportRegistrationsXLSX stream", err)
+		return
+	}
+
+	// panes must be set before any row is written
+	if err := sw.SetPanes(&excelize.Panes{Freeze: true, YSplit: 1, TopLeftCell: "A2", ActivePane: "bottomLeft"}); err != nil {
+		writeServerError(w, r, "exportRegistrationsXLSX panes", err)
+		return
+	}
+
+	bold, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	if err := sw.SetRow("A1", registrationExportHeader, excelize.RowOpts{StyleID: bold}); err != nil {
+		writeServerError(w, r, "exportRegistrationsXLSX header", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	row := 2
+	err = s.forEachRegistration(ctx, filter, func(reg Registration) error {
+		cell, err := excelize.CoordinatesToCellName(1, row)
+		if err != nil {
+			return err
+		}
+		row++
+		return sw.SetRow(cell, []any{
+			reg.RegistrationID.String(),
+			reg.FullName,
+			derefString(reg.JobTitle),
+			derefString(reg.AddressFull),
+			reg.WhatsappNumber,
+			derefString(reg.Note),
+			reg.ApplicantCount,
+			derefString(reg.VisaType),
+			reg.Status,
+			reg.CreatedAt,
+			reg.UpdatedAt,
+		})
+	})
+	if err != nil {
+		writeServerError(w, r, "exportRegistrationsXLSX query", err)
+		return
+	}
+
+	if err := sw.Flush(); err != nil {
+		writeServerError(w, r, "exportRegistrationsXLSX flush", err)
+		return
+	}
+
+	filename := "registrations-" + time.Now().UTC().Format("2006-01-02") + ".xlsx"
+	w.Header().Set("Content-Type", xlsxContentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	if _, err := f.WriteTo(w); err != nil {
+		log.Printf("exportRegistrationsXLSX write failed: %v", err)
+		return
+	}
+
+	log.Printf("exportRegistrationsXLSX wrote %d rows", row-2)
+}
+
+func derefString(p *string) string {
+	if p == nil {
+		return ""
+	}
+	return *p
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// fakePG is a stand-in Postgres for tests that check how code orders its
+// statements inside a transaction, without TEST_DATABASE_URL. It speaks just
+// enough of the wire protocol for pgx in simple-protocol mode, hands every
+// other statement to respond, and models row locks: a session that takes a
+// row lock held by another session waits until that one commits or rolls
+// back, as SELECT ... FOR UPDATE does.
+type fakePG struct {
+	respond func(sess *fakeSession, query string) fakeResult
+
+	mu    sync.Mutex
+	freed *sync.Cond
+	locks map[string]*fakeSession
+}
+
+// fakeSession is one client connection and its open transaction.
+type fakeSession struct {
+	pg       *fakePG
+	inTx     bool
+	held     []string
+	onCommit []func()
+}
+
+// fakeResult is what a statement returns: rows in text format, or an error.
+type fakeResult struct {
+	fields []pgproto3.FieldDescription
+	rows   [][][]byte
+	tag    string
+	err    string
+}
+
+// fakeValue is one column of a result row; a nil text is NULL.
+type fakeValue struct {
+	oid  uint32
+	text *string
+}
+
+func int4Value(v int) fakeValue {
+	s := strconv.Itoa(v)
+	return fakeValue{oid: 23, text: &s}
+}
+
+func int8Value(v int64) fakeValue {
+	s := strconv.FormatInt(v, 10)
+	return fakeValue{oid: 20, text: &s}
+}
+
+func uuidValue(v uuid.UUID) fakeValue {
+	s := v.String()
+	return fakeValue{oid: 2950, text: &s}
+}
+
+func textValue(v string) fakeValue {
+	return fakeValue{oid: 25, text: &v}
+}
+
+// oneRow answers a SELECT that finds a single row.
+func oneRow(values ...fakeValue) fakeResult {
+	res := fakeResult{tag: "SELECT 1"}
+	row := make([][]byte, len(values))
+	for i, v := range values {
+		res.fields = append(res.fields, pgproto3.FieldDescription{
+			Name:         []byte("col" + strconv.Itoa(i)),
+			DataTypeOID:  v.oid,
+			DataTypeSize: -1,
+			TypeModifier: -1,
+		})
+		if v.text != nil {
+			row[i] = []byte(*v.text)
+		}
+	}
+	res.rows = [][][]byte{row}
+	return res
+}
+
+func command(tag string) fakeResult {
+	return fakeResult{tag: tag}
+}
+
+func failed(msg string) fakeResult {
+	return fakeResult{err: msg}
+}
+
+// newFakePG starts a fake server and returns a pool connected to it.
+func newFakePG(t *testing.T, respond func(sess *fakeSession, query string) fakeResult) *pgxpool.Pool {
+	t.Helper()
+	pg := &fakePG{respond: respond, locks: map[string]*fakeSession{}}
+	pg.freed = sync.NewCond(&pg.mu)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go pg.serve(conn)
+		}
+	}()
+
+	pool, err := pgxpool.New(context.Background(),
+		"postgres://test@"+ln.Addr().String()+"/test?sslmode=disable&default_query_exec_mode=simple_protocol")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func (pg *fakePG) serve(conn net.Conn) {
+	defer conn.Close()
+	be := pgproto3.NewBackend(conn, conn)
+	if msg, err := be.ReceiveStartupMessage(); err != nil {
+		return
+	} else if _, ok := msg.(*pgproto3.StartupMessage); !ok {
+		return
+	}
+
+	be.Send(&pgproto3.AuthenticationOk{})
+	for name, value := range map[string]string{
+		"server_version":              "16.0",
+		"client_encoding":             "UTF8",
+		"standard_conforming_strings": "on",
+		"DateStyle":                   "ISO, MDY",
+		"integer_datetimes":           "on",
+		"TimeZone":                    "UTC",
+	} {
+		be.Send(&pgproto3.ParameterStatus{Name: name, Value: value})
+	}
+	be.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+	be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	if err := be.Flush(); err != nil {
+		return
+	}
+
+	sess := &fakeSession{pg: pg}
+	defer sess.end(false)
+	for {
+		msg, err := be.Receive()
+		if err != nil {
+			return
+		}
+		q, ok := msg.(*pgproto3.Query)
+		if !ok {
+			return
+		}
+
+		query := strings.TrimSpace(q.String)
+		var res fakeResult
+		switch strings.ToLower(query) {
+		case "":
+			be.Send(&pgproto3.EmptyQueryResponse{})
+		case "begin":
+			sess.inTx = true
+			res = command("BEGIN")
+		case "commit":
+			sess.end(true)
+			res = command("COMMIT")
+		case "rollback":
+			sess.end(false)
+			res = command("ROLLBACK")
+		default:
+			res = pg.respond(sess, query)
+		}
+		if query != "" {
+			if res.err != "" {
+				be.Send(&pgproto3.ErrorResponse{Severity: "ERROR", Code: "XX000", Message: res.err})
+			} else {
+				if res.fields != nil {
+					be.Send(&pgproto3.RowDescription{Fields: res.fields})
+				}
+				for _, row := range res.rows {
+					be.Send(&pgproto3.DataRow{Values: row})
+				}
+				be.Send(&pgproto3.CommandComplete{CommandTag: []byte(res.tag)})
+			}
+		}
+
+		status := byte('I')
+		if sess.inTx {
+			status = 'T'
+		}
+		be.Send(&pgproto3.ReadyForQuery{TxStatus: status})
+		if err := be.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// lockRow takes the row lock named key for the session's transaction,
+// waiting while another session holds it.
+func (sess *fakeSession) lockRow(key string) {
+	pg := sess.pg
+	pg.mu.Lock()
+	defer pg.mu.Unlock()
+	for pg.locks[key] != nil && pg.locks[key] != sess {
+		pg.freed.Wait()
+	}
+	if pg.locks[key] == nil {
+		pg.locks[key] = sess
+		sess.held = append(sess.held, key)
+	}
+}
+
+// holds reports whether the session's transaction holds the row lock key.
+func (sess *fakeSession) holds(key string) bool {
+	return slices.Contains(sess.held, key)
+}
+
+// afterCommit defers a change until the transaction commits, so other
+// sessions only see it then.
+func (sess *fakeSession) afterCommit(fn func()) {
+	sess.onCommit = append(sess.onCommit, fn)
+}
+
+// end finishes the transaction, applying its changes on commit, and frees
+// its row locks.
+func (sess *fakeSession) end(commit bool) {
+	if commit {
+		for _, fn := range sess.onCommit {
+			fn()
+		}
+	}
+	sess.onCommit = nil
+	sess.inTx = false
+
+	pg := sess.pg
+	pg.mu.Lock()
+	for _, key := range sess.held {
+		delete(pg.locks, key)
+	}
+	pg.mu.Unlock()
+	sess.held = nil
+	pg.freed.Broadcast()
+}
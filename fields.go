@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// registrationFields are the names ?fields= may select on registration
+// responses: the JSON names of Registration, taken from its struct tags so the
+// allowlist can't drift from the model.
+var registrationFields = jsonFieldNames(reflect.TypeFor[Registration]())
+
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// parseFields reads ?fields=a,b,c. A nil result means the parameter was
+// absent and the full object is returned. Names may be given in camelCase,
+// matching what camelCase clients see. Unknown names get a 400 written here.
+func parseFields(w http.ResponseWriter, r *http.Request, allowed []string) ([]string, bool) {
+	raw, present := r.URL.Query()["fields"]
+	if !present {
+		return nil, true
+	}
+
+	var fields, unknown []string
+	for _, part := range strings.Split(strings.Join(raw, ","), ",") {
+		name := camelToSnake(strings.TrimSpace(part))
+		switch {
+		case name == "" || slices.Contains(fields, name):
+		case slices.Contains(allowed, name):
+			fields = append(fields, name)
+		default:
+			unknown = append(unknown, strings.TrimSpace(part))
+		}
+	}
+
+	if len(unknown) > 0 || len(fields) == 0 {
+		log.Printf("invalid fields: %q", strings.Join(raw, ","))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid_fields", "unknown": unknown, "allowed": allowed})
+		return nil, false
+	}
+	return fields, true
+}
+
+// selectFields trims v, an object or a slice of objects, down to fields. With
+// no fields it returns v unchanged.
+func selectFields(v any, fields []string) (any, error) {
+	if fields == nil {
+		return v, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func(obj map[string]json.RawMessage) map[string]json.RawMessage {
+		out := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			// omitempty fields that are unset stay absent
+			if val, ok := obj[f]; ok {
+				out[f] = val
+			}
+		}
+		return out
+	}
+
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Slice {
+		var objs []map[string]json.RawMessage
+		if err := json.Unmarshal(data, &objs); err != nil {
+			return nil, err
+		}
+		selected := make([]map[string]json.RawMessage, len(objs))
+		for i, obj := range objs {
+			selected[i] = pick(obj)
+		}
+		return selected, nil
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	return pick(obj), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runtime feature flags. A flag with no feature_flags row uses its default
+// here; only names listed here can be toggled, so a typo can't create a flag
+// nothing reads.
+const (
+	flagWebhook    = "webhook"     // send registration webhooks
+	flagCVDedup    = "cv_dedup"    // skip CV uploads identical to the current CV
+	flagUploadScan = "upload_scan" // run uploads through ClamAV when configured
+)
+
+var featureFlagDefaults = map[string]bool{
+	flagWebhook:    true,
+	flagCVDedup:    true,
+	flagUploadScan: true,
+}
+
+// FeatureFlag is a flag as reported by /admin/flags.
+type FeatureFlag struct {
+	Name      string     `json:"name"`
+	Enabled   bool       `json:"enabled"`
+	Default   bool       `json:"default"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// featureFlags is the in-memory copy of the feature_flags table, reloaded
+// every FEATURE_FLAG_REFRESH so toggles made on one instance reach the others
+// without a restart.
+type featureFlags struct {
+	mu    sync.RWMutex
+	flags map[string]FeatureFlag
+}
+
+func newFeatureFlags() *featureFlags {
+	return &featureFlags{flags: map[string]FeatureFlag{}}
+}
+
+func (f *featureFlags) replace(rows []FeatureFlag) {
+	flags := make(map[string]FeatureFlag, len(rows))
+	for _, row := range rows {
+		flags[row.Name] = row
+	}
+	f.mu.Lock()
+	f.flags = flags
+	f.mu.Unlock()
+}
+
+func (f *featureFlags) set(flag FeatureFlag) {
+	f.mu.Lock()
+	f.flags[flag.Name] = flag
+	f.mu.Unlock()
+}
+
+// list returns every known flag with its effective value, sorted by name.
+func (f *featureFlags) list() []FeatureFlag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	out := make([]FeatureFlag, 0, len(featureFlagDefaults))
+	for _, name := range slices.Sorted(maps.Keys(featureFlagDefaults)) {
+		flag, ok := f.flags[name]
+		if !ok {
+			flag = FeatureFlag{Name: name, Enabled: featureFlagDefaults[name]}
+		}
+		flag.Default = featureFlagDefaults[name]
+		out = append(out, flag)
+	}
+	return out
+}
+
+// isEnabled reports a flag's current value; unknown names are off.
+func (s *server) isEnabled(name string) bool {
+	s.flags.mu.RLock()
+	flag, ok := s.flags.flags[name]
+	s.flags.mu.RUnlock()
+	if ok {
+		return flag.Enabled
+	}
+	return featureFlagDefaults[name]
+}
+
+func (s *server) refreshFeatureFlags(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		loadCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		rows, err := s.loadFeatureFlags(loadCtx)
+		cancel()
+		if err != nil {
+			log.Printf("refreshFeatureFlags: keeping previous values: %v", err)
+			continue
+		}
+		s.flags.replace(rows)
+	}
+}
+
+// adminFlagsHandler serves GET /admin/flags.
+func (s *server) adminFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("adminFlags start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodOptions:
+		writeOptions(w, "GET, OPTIONS")
+		return
+	default:
+		writeMethodNotAllowed(w, "GET, OPTIONS")
+		return
+	}
+	if !s.requireAPIKey(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.flags.list()); err != nil {
+		log.Printf("adminFlags encode failed: %v", err)
+	}
+}
+
+type updateFeatureFlagRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// adminFlagHandler serves PATCH /admin/flags/{name}. The change applies on
+// this instance at once and on the others at their next refresh.
+func (s *server) adminFlagHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("adminFlag start: method=%s path=%s remote=%s", r.Method, r.URL.Path, r.RemoteAddr)
+	switch r.Method {
+	case http.MethodPatch:
+	case http.MethodOptions:
+		writeOptions(w, "PATCH, OPTIONS")
+		return
+	default:
+		writeMethodNotAllowed(w, "PATCH, OPTIONS")
+		return
+	}
+	if !s.requireAPIKey(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	name := strings.TrimPrefix(r.URL.Path, "/admin/flags/")
+	if _, ok := featureFlagDefaults[name]; !ok || strings.Contains(name, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "flag_not_found"})
+		return
+	}
+
+	var req updateFeatureFlagRequest
+	if !decodeJSONBody(w, r, "adminFlag", &req) {
+		return
+	}
+	if req.Enabled == nil {
+		writeValidationErrors(w, validationErrors{"enabled": "enabled_required"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	flag, err := s.setFeatureFlag(ctx, name, *req.Enabled)
+	if err != nil {
+		writeServerError(w, r, "adminFlag update", err)
+		return
+	}
+	s.flags.set(flag)
+	log.Printf("adminFlag: %s set to %t", name, flag.Enabled)
+
+	flag.Default = featureFlagDefaults[name]
+	if err := json.NewEncoder(w).Encode(flag); err != nil {
+		log.Printf("adminFlag encode failed: %v", err)
+	}
+}
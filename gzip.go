@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// gzipWriterPools holds one pool per compression level so writers are reused
+// across requests instead of allocating gzip's ~800KB of state every time.
+var gzipWriterPools sync.Map // level -> *sync.Pool
+
+func gzipWriterPool(level int) *sync.Pool {
+	if p, ok := gzipWriterPools.Load(level); ok {
+		return p.(*sync.Pool)
+	}
+	p, _ := gzipWriterPools.LoadOrStore(level, &sync.Pool{
+		New: func() any {
+			zw, _ := gzip.NewWriterLevel(nil, level)
+			return zw
+		},
+	})
+	return p.(*sync.Pool)
+}
+
+// gzipResponse compresses text-like responses (JSON, NDJSON, CSV, ...) for
+// clients that send "Accept-Encoding: gzip", at GZIP_LEVEL. Files that are
+// already compressed (images, PDFs, XLSX) and responses that set their own
+// Content-Encoding pass through untouched.
+func (s *server) gzipResponse(next http.Handler) http.Handler {
+	pool := gzipWriterPool(s.cfg.GzipLevel)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w, pool: pool}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+	return false
+}
+
+// compressibleContentType reports media types worth gzipping.
+func compressibleContentType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/xml", "application/javascript", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// gzipWriter decides on the first WriteHeader whether to compress, based on
+// the status and the headers the handler set.
+type gzipWriter struct {
+	http.ResponseWriter
+	pool    *sync.Pool
+	zw      *gzip.Writer
+	decided bool
+}
+
+func (gw *gzipWriter) WriteHeader(code int) {
+	if gw.decided {
+		return
+	}
+	gw.decided = true
+
+	h := gw.Header()
+	if code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		compressibleContentType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		gw.zw = gw.pool.Get().(*gzip.Writer)
+		gw.zw.Reset(gw.ResponseWriter)
+	}
+	gw.ResponseWriter.WriteHeader(code)
+}
+
+func (gw *gzipWriter) Write(p []byte) (int, error) {
+	if !gw.decided {
+		gw.WriteHeader(http.StatusOK)
+	}
+	if gw.zw != nil {
+		return gw.zw.Write(p)
+	}
+	return gw.ResponseWriter.Write(p)
+}
+
+// Flush pushes buffered compressed bytes out so streamed responses (NDJSON)
+// still arrive incrementally.
+func (gw *gzipWriter) Flush() {
+	if gw.zw != nil {
+		_ = gw.zw.Flush()
+	}
+	_ = http.NewResponseController(gw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (gw *gzipWriter) Unwrap() http.ResponseWriter { return gw.ResponseWriter }
+
+func (gw *gzipWriter) close() {
+	if gw.zw == nil {
+		return
+	}
+	if err := gw.zw.Close(); err != nil {
+		log.Printf("gzipResponse close failed: %v", err)
+	}
+	gw.zw.Reset(nil)
+	gw.pool.Put(gw.zw)
+	gw.zw = nil
+}
+
+// gzipEncoded reports whether the request body is sent gzip-compressed.
+func gzipEncoded(r *http.Request) bool {
+	return strings.EqualFold(strings.TrimSpace(r.Header.Get("Content-Encoding")), "gzip")
+}
+
+// gunzipRequest inflates JSON request bodies sent with "Content-Encoding:
+// gzip" so the decoders further down see plain JSON. The body is inflated up
+// front, up to MAX_DECOMPRESSED_BODY_BYTES, so an oversized one is refused
+// with 413 before any handler runs. Other content types, multipart uploads
+// included, are left alone. main mounts it behind the rate limiter, so a
+// client can't make the server inflate bodies faster than it may send
+// requests. jsonCase can't re-key a compressed body, so a camelCase client's
+// body is re-keyed here once inflated.
+func (s *server) gunzipRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || !gzipEncoded(r) || !isJSONContentType(r.Header.Get("Content-Type")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := inflateBody(r.Body, s.cfg.MaxDecompressedBody)
+		if err != nil {
+			log.Printf("gunzip request failed: path=%s remote=%s err=%v", r.URL.Path, r.RemoteAddr, err)
+			w.Header().Set("Content-Type", "application/json")
+			if errors.Is(err, errBodyTooLarge) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				_ = json.NewEncoder(w).Encode(map[string]any{"error": "body_too_large", "max_bytes": s.cfg.MaxDecompressedBody})
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_gzip"})
+			return
+		}
+
+		if wantsCamelCase(r) {
+			body = snakeCaseBody(body)
+		}
+		r.Header.Del("Content-Encoding")
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		next.ServeHTTP(w, r)
+	})
+}
+
+var errBodyTooLarge = errors.New("decompressed body too large")
+
+// inflateBody reads a gzip stream, failing with errBodyTooLarge as soon as
+// the output passes limit.
+func inflateBody(body io.Reader, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	data, err := io.ReadAll(io.LimitReader(zr, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return data, nil
+}
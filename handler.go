@@ -1,16 +1,26 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,17 +28,22 @@ import (
 
 const maxUploadSize = 5 << 20 // 5MB
 
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
 func (s *server) usersHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
 		s.getUsersHandler(w, r)
 	case http.MethodPost:
 		s.createUserHandler(w, r)
+	case http.MethodOptions:
+		writeOptions(w, "GET, POST, OPTIONS")
 	default:
 		log.Printf("usersHandler invalid method: %s", r.Method)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 	}
 }
 
@@ -36,9 +51,24 @@ func (s *server) getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("getUsers start: method=%s remote=%s", r.Method, r.RemoteAddr)
 	if r.Method != http.MethodGet {
 		log.Printf("getUsers invalid method: %s", r.Method)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
+		return
+	}
+
+	if r.URL.Query().Has("ids") {
+		s.getUsersByIDsHandler(w, r)
+		return
+	}
+
+	sort, order, ok := parseSort(r, userSortColumns)
+	if !ok {
+		writeInvalidSort(w, userSortColumns)
+		return
+	}
+	desc := s.sortDesc(order)
+
+	if acceptsNDJSON(r) {
+		s.streamUsersNDJSON(w, r, listUsersParams{Sort: sort, Desc: desc})
 		return
 	}
 
@@ -47,30 +77,186 @@ func (s *server) getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
+	// v1 pages the list and wraps it in an envelope; the deprecated
+	// unversioned route keeps returning every user as a bare array.
+	enveloped := apiVersion(r) == "v1"
+	params := listUsersParams{Sort: sort, Desc: desc}
+	if enveloped {
+		if params.Limit, params.Offset, ok = parsePagination(w, r); !ok {
+			return
+		}
+	}
+
 	log.Println("getUsers querying database")
-	users, err := s.fetchUsers(ctx)
+	users, total, err := s.fetchUsersPage(ctx, params, enveloped)
 	if err != nil {
-		log.Printf("getUsers query failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
-		return
+		staleUsers, staleTotal, ok := s.usersStale.get(params)
+		if !ok || r.Context().Err() != nil {
+			writeServerError(w, r, "getUsers query", err)
+			return
+		}
+		log.Printf("getUsers serving stale list after query failure: %v", err)
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		users, total = staleUsers, staleTotal
+	} else {
+		s.usersStale.put(params, users, total)
 	}
 
 	for i := range users {
-		if users[i].HasCV {
-			url := buildDownloadURL(r, users[i].ID)
+		if users[i].HasCV && includeCVURL(r) {
+			url := s.buildDownloadURL(r, users[i].ID)
 			users[i].CvFileDownloadURL = &url
 		}
 	}
 
+	var resp any = users
+	if enveloped {
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		resp = listEnvelope{Data: users, Meta: listMeta{Total: total, Limit: params.Limit, Offset: params.Offset}}
+	}
+
 	log.Printf("getUsers returning %d users", len(users))
-	if err := json.NewEncoder(w).Encode(users); err != nil {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("getUsers encode failed: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
 	}
 }
 
+// maxUserIDs caps how many users one ?ids= lookup may ask for.
+const maxUserIDs = 100
+
+// getUsersByIDsHandler serves GET /users?ids=1,2,3 so clients can hydrate a
+// set of users in one call. Unknown ids are left out of the array.
+func (s *server) getUsersByIDsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, raw := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		raw = strings.TrimSpace(raw)
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_ids", "value": raw})
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	if len(ids) > maxUserIDs {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "too_many_ids", "max": maxUserIDs})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	users, err := s.fetchUsersByIDs(ctx, ids)
+	if err != nil {
+		writeServerError(w, r, "getUsersByIDs query", err)
+		return
+	}
+
+	for i := range users {
+		if users[i].HasCV && includeCVURL(r) {
+			url := s.buildDownloadURL(r, users[i].ID)
+			users[i].CvFileDownloadURL = &url
+		}
+	}
+
+	log.Printf("getUsersByIDs returning %d of %d users", len(users), len(ids))
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		log.Printf("getUsersByIDs encode failed: %v", err)
+	}
+}
+
+// fetchUsersPage loads one page of users, plus the total when the response
+// is enveloped.
+func (s *server) fetchUsersPage(ctx context.Context, p listUsersParams, withTotal bool) ([]User, int, error) {
+	users, err := s.fetchUsers(ctx, p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !withTotal {
+		return users, 0, nil
+	}
+	total, err := s.countUsers(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// includeCVURL reports whether user lists should carry cv_file_download_url;
+// ?include_cv_url=false skips building them when has_cv is enough.
+func includeCVURL(r *http.Request) bool {
+	include, err := strconv.ParseBool(r.URL.Query().Get("include_cv_url"))
+	return err != nil || include
+}
+
+const ndjsonContentType = "application/x-ndjson"
+
+func acceptsNDJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// streamUsersNDJSON writes every user, up to MAX_RESULT_ROWS, as one JSON
+// object per line, straight from the database cursor. Once the first line is
+// out the status is committed, so a mid-stream failure can only be logged and
+// the body cut short.
+func (s *server) streamUsersNDJSON(w http.ResponseWriter, r *http.Request, params listUsersParams) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+
+	withURL := includeCVURL(r)
+	n := 0
+	err := s.streamUsers(ctx, params, func(u User) error {
+		if n == 0 {
+			w.Header().Set("Content-Type", ndjsonContentType)
+			w.WriteHeader(http.StatusOK)
+		}
+		if u.HasCV && withURL {
+			url := s.buildDownloadURL(r, u.ID)
+			u.CvFileDownloadURL = &url
+		}
+		if err := enc.Encode(u); err != nil {
+			return err
+		}
+		n++
+		if n%100 == 0 {
+			_ = rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if n == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			writeServerError(w, r, "getUsers stream", err)
+			return
+		}
+		log.Printf("getUsers stream aborted after %d users: %v", n, err)
+		return
+	}
+	if n == 0 {
+		w.Header().Set("Content-Type", ndjsonContentType)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	log.Printf("getUsers streamed %d users as ndjson", n)
+}
+
 type createUserRequest struct {
 	Name *string `json:"name"`
 	Age  *int    `json:"age"`
@@ -86,23 +272,26 @@ type createRegistrationRequest struct {
 	VisaType       *string `json:"visa_type"`
 }
 
+// applicantCount is the requested applicant_count, or 1 when it was left out.
+func (req createRegistrationRequest) applicantCount() int {
+	if req.ApplicantCount != nil {
+		return *req.ApplicantCount
+	}
+	return 1
+}
+
 func (s *server) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("createUser start: method=%s remote=%s", r.Method, r.RemoteAddr)
 	if r.Method != http.MethodPost {
 		log.Printf("createUser invalid method: %s", r.Method)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	var req createUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("createUser decode failed: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_json"})
+	if !decodeJSONBody(w, r, "createUser", &req) {
 		return
 	}
 
@@ -112,9 +301,7 @@ func (s *server) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("createUser inserting into database")
 	user, err := s.insertUser(ctx, req)
 	if err != nil {
-		log.Printf("createUser insert failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+		writeServerError(w, r, "createUser insert", err)
 		return
 	}
 
@@ -128,581 +315,2359 @@ func (s *server) createUserHandler(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) registrationsHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
+	case http.MethodGet:
+		s.listRegistrationsHandler(w, r)
 	case http.MethodPost:
 		s.createRegistrationHandler(w, r)
+	case http.MethodOptions:
+		writeOptions(w, "GET, POST, OPTIONS")
 	default:
 		log.Printf("registrationsHandler invalid method: %s", r.Method)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 	}
 }
 
-func (s *server) registrationDetailHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) < 2 || parts[0] != "registrations" {
-		notFoundHandler(w, r)
+func (s *server) listRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("listRegistrations start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		log.Printf("listRegistrations invalid method: %s", r.Method)
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 		return
 	}
 
-	regID, err := uuid.Parse(parts[1])
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_registration_id"})
+	w.Header().Set("Content-Type", "application/json")
+
+	q := r.URL.Query()
+	sort, order, ok := parseSort(r, registrationSortColumns)
+	if !ok {
+		writeInvalidSort(w, registrationSortColumns)
 		return
 	}
+	if sort == "" {
+		sort = "created_at"
+	}
 
-	if len(parts) == 2 {
-		if r.Method == http.MethodGet {
-			s.getRegistrationHandler(w, r, regID)
+	// created_at defaults to newest first; the other fields read naturally
+	// ascending.
+	params := listRegistrationsParams{
+		Sort: sort,
+		Desc: order == "desc" || (order == "" && (sort == "created_at" || s.sortDesc(order))),
+	}
+	if params.Limit, params.Offset, ok = parsePagination(w, r); !ok {
+		return
+	}
+	if raw := q.Get("archived"); raw != "" {
+		archived, err := strconv.ParseBool(raw)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_archived", "value": raw})
 			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
-		return
+		params.Archived = archived
 	}
-
-	notFoundHandler(w, r)
-}
-
-func (s *server) createRegistrationHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("createRegistration start: method=%s remote=%s", r.Method, r.RemoteAddr)
-	if r.Method != http.MethodPost {
-		log.Printf("createRegistration invalid method: %s", r.Method)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+	fields, ok := parseFields(w, r, registrationFields)
+	if !ok {
 		return
 	}
+	if raw := q.Get("cursor"); raw != "" {
+		cursor, err := decodeRegistrationCursor(raw)
+		if err != nil || cursor.Sort != params.Sort || cursor.Desc != params.Desc {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_cursor"})
+			return
+		}
+		params.Cursor = &cursor
+	}
 
-	w.Header().Set("Content-Type", "application/json")
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
 
-	var req createRegistrationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("createRegistration decode failed: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_json"})
+	registrations, err := s.listRegistrations(ctx, params)
+	if err != nil {
+		writeServerError(w, r, "listRegistrations query", err)
 		return
 	}
 
-	if strings.TrimSpace(req.FullName) == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "full_name_required"})
-		return
+	var nextCursor string
+	if len(registrations) == params.Limit {
+		last := registrations[len(registrations)-1]
+		nextCursor = encodeRegistrationCursor(registrationCursor{
+			Sort:           params.Sort,
+			Desc:           params.Desc,
+			Value:          params.sortColumn().value(last),
+			RegistrationID: last.RegistrationID,
+		})
+		w.Header().Set("X-Next-Cursor", nextCursor)
 	}
 
-	if strings.TrimSpace(req.WhatsappNumber) == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "whatsapp_number_required"})
+	data, err := selectFields(registrations, fields)
+	if err != nil {
+		writeServerError(w, r, "listRegistrations select fields", err)
 		return
 	}
 
-	if req.ApplicantCount != nil && *req.ApplicantCount < 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_applicant_count"})
-		return
+	resp := data
+	if apiVersion(r) == "v1" {
+		total, err := s.countRegistrations(ctx, params.Archived)
+		if err != nil {
+			writeServerError(w, r, "listRegistrations count", err)
+			return
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		resp = listEnvelope{Data: data, Meta: listMeta{
+			Total:      total,
+			Limit:      params.Limit,
+			Offset:     params.Offset,
+			NextCursor: nextCursor,
+		}}
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
-
-	log.Println("createRegistration inserting into database")
-	registration, err := s.insertRegistration(ctx, req)
-	if err != nil {
-		log.Printf("createRegistration insert failed: %v", err)
+	log.Printf("listRegistrations returning %d registrations", len(registrations))
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("listRegistrations encode failed: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
-		return
 	}
+}
 
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(registration); err != nil {
-		log.Printf("createRegistration encode failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+// parseRegistrationFilter reads ?created_from= and ?created_to= as
+// YYYY-MM-DD dates (UTC); created_to is inclusive of that whole day.
+func parseRegistrationFilter(r *http.Request) (registrationFilter, string) {
+	q := r.URL.Query()
+	var f registrationFilter
+	if v := q.Get("created_from"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return registrationFilter{}, "invalid_created_from"
+		}
+		f.CreatedFrom = &t
 	}
+	if v := q.Get("created_to"); v != "" {
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return registrationFilter{}, "invalid_created_to"
+		}
+		t = t.AddDate(0, 0, 1)
+		f.CreatedTo = &t
+	}
+	return f, ""
 }
 
-func (s *server) getRegistrationHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
-	log.Printf("getRegistration start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
-	if r.Method != http.MethodGet {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
-		return
+// parseSort reads ?sort=<field>&order=asc|desc. field is "" when no sort was
+// given and order is "" when no order was; ok is false for a field outside
+// allowed or an unknown order.
+func parseSort[V any](r *http.Request, allowed map[string]V) (field, order string, ok bool) {
+	q := r.URL.Query()
+	field = strings.ToLower(strings.TrimSpace(q.Get("sort")))
+	if field != "" {
+		if _, known := allowed[field]; !known {
+			return "", "", false
+		}
+	}
+	order = strings.ToLower(strings.TrimSpace(q.Get("order")))
+	if order != "" && order != "asc" && order != "desc" {
+		return "", "", false
+	}
+	return field, order, true
+}
+
+// sortDesc resolves an ?order= value, applying DEFAULT_SORT_ORDER when the
+// request gave none.
+func (s *server) sortDesc(order string) bool {
+	if order == "" {
+		order = s.cfg.DefaultSortOrder
 	}
+	return order == "desc"
+}
 
+func writeInvalidSort[V any](w http.ResponseWriter, allowed map[string]V) {
+	fields := slices.Sorted(maps.Keys(allowed))
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":          "invalid_sort",
+		"allowed_fields": fields,
+		"allowed_orders": []string{"asc", "desc"},
+	})
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+// parsePagination reads ?limit= and ?offset=, applying defaultPageLimit and
+// capping at maxPageLimit. Only omitted params take defaults: a value that
+// isn't a positive limit or a non-negative offset writes 400
+// invalid_pagination naming the param, and ok is false.
+func parsePagination(w http.ResponseWriter, r *http.Request) (limit, offset int, ok bool) {
+	q := r.URL.Query()
+	limit = defaultPageLimit
+	if q.Has("limit") {
+		v, err := strconv.Atoi(q.Get("limit"))
+		if err != nil || v < 1 {
+			writeInvalidPagination(w, "limit", q.Get("limit"))
+			return 0, 0, false
+		}
+		limit = min(v, maxPageLimit)
+	}
+	if q.Has("offset") {
+		v, err := strconv.Atoi(q.Get("offset"))
+		if err != nil || v < 0 {
+			writeInvalidPagination(w, "offset", q.Get("offset"))
+			return 0, 0, false
+		}
+		offset = v
+	}
+	return limit, offset, true
+}
 
-	registration, err := s.getRegistrationByID(ctx, registrationID)
+func writeInvalidPagination(w http.ResponseWriter, param, value string) {
+	log.Printf("invalid pagination: %s=%q", param, value)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_pagination", "param": param, "value": value})
+}
+
+func encodeRegistrationCursor(c registrationCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeRegistrationCursor also accepts the original "created_at|id" cursors,
+// which always meant created_at descending.
+func decodeRegistrationCursor(s string) (registrationCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
-		if errors.Is(err, errRegistrationNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
-			return
+		return registrationCursor{}, err
+	}
+
+	var c registrationCursor
+	if bytes.HasPrefix(raw, []byte("{")) {
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return registrationCursor{}, err
 		}
-		log.Printf("getRegistration fetch failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
-		return
+		col, ok := registrationSortColumns[c.Sort]
+		if !ok || c.RegistrationID == uuid.Nil {
+			return registrationCursor{}, errors.New("malformed cursor")
+		}
+		// the value is cast in SQL, so reject anything the cast would fail on
+		switch col.sqlType {
+		case "timestamptz":
+			_, err = time.Parse(time.RFC3339Nano, c.Value)
+		case "int":
+			_, err = strconv.Atoi(c.Value)
+		}
+		if err != nil {
+			return registrationCursor{}, err
+		}
+		return c, nil
 	}
 
-	if err := json.NewEncoder(w).Encode(registration); err != nil {
-		log.Printf("getRegistration encode failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return registrationCursor{}, errors.New("malformed cursor")
 	}
+
+	if _, err := time.Parse(time.RFC3339Nano, createdAt); err != nil {
+		return registrationCursor{}, err
+	}
+	if c.RegistrationID, err = uuid.Parse(id); err != nil {
+		return registrationCursor{}, err
+	}
+	c.Sort, c.Desc, c.Value = "created_at", true, createdAt
+	return c, nil
 }
 
-func (s *server) uploadRegistrationFileHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
-	log.Printf("uploadRegistrationFile start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
-	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+// registrationSubresources are the segments served under /registrations/{id}.
+var registrationSubresources = []string{"completeness", "files", "notify", "qr", "timeline"}
+
+func (s *server) registrationDetailHandler(w http.ResponseWriter, r *http.Request) {
+	parts, ok := routeSegments(w, r, 4)
+	if !ok {
+		return
+	}
+	if len(parts) < 2 || parts[0] != "registrations" {
+		notFoundHandler(w, r)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1024)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		log.Printf("uploadRegistrationFile parse form failed: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+	if len(parts) == 2 && parts[1] == "bulk" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "POST, OPTIONS")
+			return
+		}
+		s.bulkCreateRegistrationsHandler(w, r)
 		return
 	}
 
-	fileType := strings.TrimSpace(r.FormValue("file_type"))
-	if fileType == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_type_required"})
+	if len(parts) == 2 && parts[1] == "validate" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "POST, OPTIONS")
+			return
+		}
+		s.validateRegistrationHandler(w, r)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("uploadRegistrationFile missing file: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_required"})
+	if len(parts) == 2 && parts[1] == "stats" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "GET, OPTIONS")
+			return
+		}
+		s.registrationStatsHandler(w, r)
 		return
 	}
-	defer file.Close()
 
-	if header.Size > maxUploadSize {
-		log.Printf("uploadRegistrationFile file too large: %d bytes", header.Size)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_too_large"})
+	if len(parts) == 2 && parts[1] == "status" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "POST, OPTIONS")
+			return
+		}
+		s.bulkUpdateStatusHandler(w, r)
 		return
 	}
 
-	buf := bytes.NewBuffer(nil)
-	n, err := io.Copy(buf, io.LimitReader(file, maxUploadSize+1))
-	if err != nil {
-		log.Printf("uploadRegistrationFile read failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+	if len(parts) == 2 && parts[1] == "export.xlsx" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "GET, OPTIONS")
+			return
+		}
+		s.exportRegistrationsXLSXHandler(w, r)
 		return
 	}
 
-	if n > maxUploadSize {
-		log.Printf("uploadRegistrationFile exceeded limit during read: %d bytes", n)
+	regID, err := uuid.Parse(parts[1])
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_too_large"})
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_registration_id"})
 		return
 	}
 
-	fileData := buf.Bytes()
-	if len(fileData) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "empty_file"})
+	if len(parts) >= 3 && !slices.Contains(registrationSubresources, parts[2]) {
+		writeUnknownSubresource(w, r, parts[2], registrationSubresources)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			s.getRegistrationHandler(w, r, regID)
+		case http.MethodPut, http.MethodPatch:
+			s.updateRegistrationHandler(w, r, regID)
+		case http.MethodOptions:
+			writeOptions(w, "GET, PUT, PATCH, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "GET, PUT, PATCH, OPTIONS")
+		}
+		return
+	}
 
-	fileID, err := s.saveRegistrationFile(ctx, registrationID, fileType, header.Filename, fileData)
-	if err != nil {
-		if errors.Is(err, errRegistrationNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+	if len(parts) == 3 && parts[2] == "qr" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "GET, OPTIONS")
 			return
 		}
-		log.Printf("uploadRegistrationFile save failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+		s.registrationQRHandler(w, r, regID)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(map[string]string{
-		"status":  "uploaded",
-		"file_id": fileID.String(),
-	})
-}
-
-func (s *server) registrationFilesHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("registrationFiles start: method=%s remote=%s", r.Method, r.RemoteAddr)
-	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+	if len(parts) == 3 && parts[2] == "completeness" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "GET, OPTIONS")
+			return
+		}
+		s.registrationCompletenessHandler(w, r, regID)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1024)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		log.Printf("registrationFiles parse form failed: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+	if len(parts) == 3 && parts[2] == "timeline" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "GET, OPTIONS")
+			return
+		}
+		s.registrationTimelineHandler(w, r, regID)
 		return
 	}
 
-	regIDStr := strings.TrimSpace(r.FormValue("registration_id"))
-	if regIDStr == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_id_required"})
+	if len(parts) == 3 && parts[2] == "notify" {
+		switch r.Method {
+		case http.MethodPost:
+			if !s.requireAPIKey(w, r) {
+				return
+			}
+			s.notifyRegistrationHandler(w, r, regID)
+		case http.MethodOptions:
+			writeOptions(w, "POST, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "POST, OPTIONS")
+		}
 		return
 	}
 
-	regID, err := uuid.Parse(regIDStr)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_registration_id"})
+	if len(parts) == 3 && parts[2] == "files" {
+		switch r.Method {
+		case http.MethodGet:
+			s.listRegistrationFilesHandler(w, r, regID)
+		case http.MethodPost:
+			s.uploadRegistrationFileHandler(w, r, regID)
+		case http.MethodOptions:
+			writeOptions(w, "GET, POST, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "GET, POST, OPTIONS")
+		}
 		return
 	}
 
-	fileType := strings.TrimSpace(r.FormValue("file_type"))
-	if fileType == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_type_required"})
+	if len(parts) == 4 && parts[2] == "files" {
+		fileID, err := uuid.Parse(parts[3])
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_file_id"})
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.downloadRegistrationFileHandler(w, r, fileID, regID)
+		case http.MethodOptions:
+			writeOptions(w, "GET, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "GET, OPTIONS")
+		}
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("registrationFiles missing file: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_required"})
-		return
-	}
-	defer file.Close()
+	notFoundHandler(w, r)
+}
 
-	if header.Size > maxUploadSize {
-		log.Printf("registrationFiles file too large: %d bytes", header.Size)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_too_large"})
+func (s *server) createRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("createRegistration start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		log.Printf("createRegistration invalid method: %s", r.Method)
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 		return
 	}
 
-	buf := bytes.NewBuffer(nil)
-	n, err := io.Copy(buf, io.LimitReader(file, maxUploadSize+1))
-	if err != nil {
-		log.Printf("registrationFiles read failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
-		return
-	}
+	w.Header().Set("Content-Type", "application/json")
 
-	if n > maxUploadSize {
-		log.Printf("registrationFiles exceeded limit during read: %d bytes", n)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_too_large"})
+	var req createRegistrationRequest
+	if !decodeJSONBody(w, r, "createRegistration", &req) {
 		return
 	}
 
-	fileData := buf.Bytes()
-	if len(fileData) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "empty_file"})
+	if errs := s.validateRegistrationRequest(&req); errs != nil {
+		logValidationRejections("createRegistration", errs)
+		writeValidationErrors(w, errs)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	fileID, err := s.saveRegistrationFile(ctx, regID, fileType, header.Filename, fileData)
+	log.Println("createRegistration inserting into database")
+	registration, err := s.insertRegistration(ctx, req)
 	if err != nil {
-		if errors.Is(err, errRegistrationNotFound) {
-			w.WriteHeader(http.StatusNotFound)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+		if errors.Is(err, errRegistrationLimitReached) {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "registration_limit_reached", "limit": s.cfg.MaxRegistrationsPerWhatsapp})
 			return
 		}
-		log.Printf("registrationFiles save failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+		writeServerError(w, r, "createRegistration insert", err)
 		return
 	}
+	if s.isEnabled(flagWebhook) {
+		s.webhook.notify("registration.created", registration)
+	}
 
 	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(map[string]string{
-		"status":  "uploaded",
-		"file_id": fileID.String(),
-	})
+	if err := json.NewEncoder(w).Encode(registration); err != nil {
+		log.Printf("createRegistration encode failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+	}
 }
 
-func (s *server) registrationFileHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) != 2 || parts[0] != "registration-files" {
-		notFoundHandler(w, r)
-		return
-	}
+// validationErrors maps a request field to the code of the rule it failed.
+type validationErrors map[string]string
 
-	fileID, err := uuid.Parse(parts[1])
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_file_id"})
-		return
-	}
+type validationRejectionLog struct {
+	Level   string `json:"level"`
+	Msg     string `json:"msg"`
+	Handler string `json:"handler"`
+	Field   string `json:"field"`
+	Reason  string `json:"reason"`
+}
 
-	if r.Method != http.MethodGet {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
-		return
+// logValidationRejections logs one JSON line per failed field and counts it
+// in validation_rejections_total. Only field names and rule codes are
+// logged, never the submitted values.
+func logValidationRejections(handler string, errs validationErrors) {
+	for _, field := range slices.Sorted(maps.Keys(errs)) {
+		validationRejections.WithLabelValues(field).Inc()
+		b, err := json.Marshal(validationRejectionLog{
+			Level:   "INFO",
+			Msg:     "validation rejected",
+			Handler: handler,
+			Field:   field,
+			Reason:  errs[field],
+		})
+		if err != nil {
+			continue
+		}
+		log.Println(string(b))
 	}
+}
 
-	s.downloadRegistrationFileHandler(w, r, fileID)
+func writeValidationErrors(w http.ResponseWriter, fields validationErrors) {
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": "validation_failed", "fields": fields})
 }
 
-func (s *server) downloadRegistrationFileHandler(w http.ResponseWriter, r *http.Request, fileID uuid.UUID) {
-	log.Printf("downloadRegistrationFile start: fileID=%s method=%s remote=%s", fileID.String(), r.Method, r.RemoteAddr)
-	if r.Method != http.MethodGet {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
-		return
-	}
+// validateRegistrationRequest checks every rule on a registration payload and
+// normalizes the WhatsApp number and visa type in place. It returns all
+// failures at once, or nil when the request is valid.
+func (s *server) validateRegistrationRequest(req *createRegistrationRequest) validationErrors {
+	errs := validationErrors{}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
-	defer cancel()
+	if strings.TrimSpace(req.FullName) == "" {
+		errs["full_name"] = "full_name_required"
+	}
 
-	rf, err := s.getRegistrationFile(ctx, fileID)
-	if err != nil {
-		if errors.Is(err, errFileNotFound) {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
-			return
-		}
-		log.Printf("downloadRegistrationFile fetch failed: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
-		return
+	if strings.TrimSpace(req.WhatsappNumber) == "" {
+		errs["whatsapp_number"] = "whatsapp_number_required"
+	} else if normalized, ok := normalizeWhatsappNumber(req.WhatsappNumber); ok {
+		req.WhatsappNumber = normalized
+	} else {
+		errs["whatsapp_number"] = "invalid_whatsapp_number"
 	}
 
-	if len(rf.Data) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
-		return
+	if req.ApplicantCount != nil && *req.ApplicantCount < 1 {
+		errs["applicant_count"] = "invalid_applicant_count"
 	}
 
-	contentType := http.DetectContentType(rf.Data)
-	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", rf.Filename))
-	if rf.FileSize > 0 {
-		w.Header().Set("Content-Length", strconv.FormatInt(rf.FileSize, 10))
+	if req.VisaType != nil {
+		visaType := strings.ToLower(strings.TrimSpace(*req.VisaType))
+		if !slices.Contains(s.cfg.VisaTypes, visaType) {
+			errs["visa_type"] = "invalid_visa_type"
+		}
+		req.VisaType = &visaType
 	}
 
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(rf.Data); err != nil {
-		log.Printf("downloadRegistrationFile write failed: %v", err)
+	if len(errs) == 0 {
+		return nil
 	}
+	return errs
 }
 
-func (s *server) userCVHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
-	if len(parts) != 3 || parts[0] != "users" || parts[2] != "cv" {
-		notFoundHandler(w, r)
+// validateRegistrationHandler serves POST /registrations/validate: the create
+// validation without the insert, so clients can pre-check a payload. A valid
+// payload is echoed back normalized, as it would be stored.
+func (s *server) validateRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("validateRegistration start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST, OPTIONS")
 		return
 	}
 
-	userID, err := strconv.ParseInt(parts[1], 10, 64)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_user_id"})
+	w.Header().Set("Content-Type", "application/json")
+
+	var req createRegistrationRequest
+	if !decodeJSONBody(w, r, "validateRegistration", &req) {
 		return
 	}
 
-	switch r.Method {
-	case http.MethodGet:
-		s.downloadUserCVHandler(w, r, userID)
-	case http.MethodPost:
-		s.uploadUserCVHandler(w, r, userID)
-	default:
-		log.Printf("userCVHandler invalid method: %s", r.Method)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+	if errs := s.validateRegistrationRequest(&req); errs != nil {
+		writeValidationErrors(w, errs)
+		return
 	}
+	applicantCount := req.applicantCount()
+	req.ApplicantCount = &applicantCount
+
+	_ = json.NewEncoder(w).Encode(map[string]any{"valid": true, "normalized": req})
 }
 
-func (s *server) uploadUserCVHandler(w http.ResponseWriter, r *http.Request, userID int64) {
-	log.Printf("uploadUserCV start: userID=%d method=%s remote=%s", userID, r.Method, r.RemoteAddr)
+func (s *server) bulkCreateRegistrationsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("bulkCreateRegistrations start: method=%s remote=%s", r.Method, r.RemoteAddr)
 	if r.Method != http.MethodPost {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+		log.Printf("bulkCreateRegistrations invalid method: %s", r.Method)
+		writeMethodNotAllowed(w, "POST, OPTIONS")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
-	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1024)
-	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
-		log.Printf("uploadUserCV parse form failed: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+	reqs, ok := decodeJSONArray[createRegistrationRequest](w, r, "bulkCreateRegistrations", s.cfg.BulkRegistrationMax)
+	if !ok {
 		return
 	}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		log.Printf("uploadUserCV missing file: %v", err)
+	if len(reqs) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_required"})
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "empty_batch"})
 		return
 	}
-	defer file.Close()
 
-	if header.Size > maxUploadSize {
-		log.Printf("uploadUserCV file too large: %d bytes", header.Size)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_too_large"})
-		return
+	for i := range reqs {
+		if errs := s.validateRegistrationRequest(&reqs[i]); errs != nil {
+			log.Printf("bulkCreateRegistrations rejected index=%d", i)
+			logValidationRejections("bulkCreateRegistrations", errs)
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid_registration", "index": i, "fields": errs})
+			return
+		}
 	}
 
-	buf := bytes.NewBuffer(nil)
-	n, err := io.Copy(buf, io.LimitReader(file, maxUploadSize+1))
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	log.Printf("bulkCreateRegistrations inserting %d registrations", len(reqs))
+	registrations, err := s.insertRegistrations(ctx, reqs)
 	if err != nil {
-		log.Printf("uploadUserCV read failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+		if errors.Is(err, errRegistrationLimitReached) {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "registration_limit_reached", "limit": s.cfg.MaxRegistrationsPerWhatsapp})
+			return
+		}
+		writeServerError(w, r, "bulkCreateRegistrations insert", err)
 		return
 	}
+	if s.isEnabled(flagWebhook) {
+		for _, reg := range registrations {
+			s.webhook.notify("registration.created", reg)
+		}
+	}
 
-	if n > maxUploadSize {
-		log.Printf("uploadUserCV file exceeded limit during read: %d bytes", n)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_too_large"})
-		return
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(registrations); err != nil {
+		log.Printf("bulkCreateRegistrations encode failed: %v", err)
 	}
+}
 
-	cvData := buf.Bytes()
-	if len(cvData) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "empty_file"})
+func (s *server) getRegistrationHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("getRegistration start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, PUT, PATCH, OPTIONS")
 		return
 	}
 
-	mimeType := http.DetectContentType(cvData)
-	contentTypeHeader := header.Header.Get("Content-Type")
-	if mimeType != "application/pdf" && contentTypeHeader != "application/pdf" {
-		log.Printf("uploadUserCV invalid mime type: detected=%s header=%s", mimeType, contentTypeHeader)
-		w.WriteHeader(http.StatusBadRequest)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_file_type"})
+	w.Header().Set("Content-Type", "application/json")
+
+	fields, ok := parseFields(w, r, registrationFields)
+	if !ok {
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	if err := s.saveUserCV(ctx, userID, cvData); err != nil {
-		if errors.Is(err, errUserNotFound) {
+	registration, err := s.getRegistrationByID(ctx, registrationID)
+	if err != nil {
+		if errors.Is(err, errRegistrationNotFound) {
 			w.WriteHeader(http.StatusNotFound)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
 			return
 		}
-		log.Printf("uploadUserCV save failed: %v", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+		writeServerError(w, r, "getRegistration fetch", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
-	_ = json.NewEncoder(w).Encode(map[string]string{"status": "uploaded"})
+	resp, err := selectFields(registration, fields)
+	if err != nil {
+		writeServerError(w, r, "getRegistration select fields", err)
+		return
+	}
+	setRegistrationValidators(w, registration)
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("getRegistration encode failed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+	}
 }
 
-func (s *server) downloadUserCVHandler(w http.ResponseWriter, r *http.Request, userID int64) {
-	log.Printf("downloadUserCV start: userID=%d method=%s remote=%s", userID, r.Method, r.RemoteAddr)
+func (s *server) listRegistrationFilesHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("listRegistrationFiles start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
 	if r.Method != http.MethodGet {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+
+	includeDeleted, _ := strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
-	cvData, err := s.getUserCV(ctx, userID)
+	files, err := s.listRegistrationFiles(ctx, registrationID, includeDeleted)
 	if err != nil {
-		if errors.Is(err, errUserNotFound) {
-			w.Header().Set("Content-Type", "application/json")
+		if errors.Is(err, errRegistrationNotFound) {
 			w.WriteHeader(http.StatusNotFound)
-			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
 			return
 		}
-		log.Printf("downloadUserCV fetch failed: %v", err)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusInternalServerError)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+		writeServerError(w, r, "listRegistrationFiles fetch", err)
 		return
 	}
 
-	if len(cvData) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		_ = json.NewEncoder(w).Encode(map[string]string{"error": "cv_not_found"})
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("listRegistrationFiles encode failed: %v", err)
+	}
+}
+
+func (s *server) uploadRegistrationFileHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("uploadRegistrationFile start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", "attachment; filename=\"cv-"+strconv.FormatInt(userID, 10)+".pdf\"")
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(cvData); err != nil {
-		log.Printf("downloadUserCV write failed: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
 	}
-}
 
-func buildDownloadURL(r *http.Request, userID int64) string {
-	scheme := "http"
-	if r.TLS != nil {
-		scheme = "https"
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
 	}
-	base := fmt.Sprintf("%s://%s", scheme, r.Host)
-	if strings.HasPrefix(serviceHost, "http://") || strings.HasPrefix(serviceHost, "https://") {
-		base = serviceHost
+	defer release()
+
+	defer removeUploadTempFiles(r)
+	if err := s.parseUploadForm(w, r, maxUploadSize); err != nil {
+		log.Printf("uploadRegistrationFile parse form failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+		return
 	}
-	return base + fmt.Sprintf(cvDownloadPathTemplate, userID)
-}
 
-func pingHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("ping request: method=%s remote=%s", r.Method, r.RemoteAddr)
-	w.Header().Set("Content-Type", "application/json")
+	fileType := normalizeFileType(r.FormValue("file_type"))
+	if fileType == "" {
+		writeMissingFormField(w, r, "file_type", "file_type_required")
+		return
+	}
 
-	resp := map[string]string{"message": "pong v2"}
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		// Best-effort error response if encoding fails
-		http.Error(w, `{"error":"internal_error"}`, http.StatusInternalServerError)
+	fileData, header, err := readUploadFile(r, "file", maxUploadSize)
+	if err != nil {
+		writeUploadError(w, "uploadRegistrationFile", err)
+		return
 	}
+
+	s.storeRegistrationFile(w, r, "uploadRegistrationFile", registrationID, fileType, header.Filename, fileData)
 }
 
-func notFoundHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("not found: path=%s method=%s remote=%s", r.URL.Path, r.Method, r.RemoteAddr)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusNotFound)
-	_ = json.NewEncoder(w).Encode(map[string]string{"error": "not_found"})
+func (s *server) registrationFilesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("registrationFiles start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method == http.MethodOptions {
+		writeOptions(w, "POST, OPTIONS")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST, OPTIONS")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
+	}
+
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	defer removeUploadTempFiles(r)
+	if err := s.parseUploadForm(w, r, maxUploadSize); err != nil {
+		log.Printf("registrationFiles parse form failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+		return
+	}
+
+	regIDStr := strings.TrimSpace(r.FormValue("registration_id"))
+	if regIDStr == "" {
+		writeMissingFormField(w, r, "registration_id", "registration_id_required")
+		return
+	}
+
+	regID, err := uuid.Parse(regIDStr)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_registration_id"})
+		return
+	}
+
+	fileType := normalizeFileType(r.FormValue("file_type"))
+	if fileType == "" {
+		writeMissingFormField(w, r, "file_type", "file_type_required")
+		return
+	}
+
+	fileData, header, err := readUploadFile(r, "file", maxUploadSize)
+	if err != nil {
+		writeUploadError(w, "registrationFiles", err)
+		return
+	}
+
+	s.storeRegistrationFile(w, r, "registrationFiles", regID, fileType, header.Filename, fileData)
+}
+
+// storeRegistrationFile scans, validates and saves uploaded registration file
+// bytes, then writes the 201 (or the rejection). It reports whether the file
+// was saved.
+func (s *server) storeRegistrationFile(w http.ResponseWriter, r *http.Request, op string, registrationID uuid.UUID, fileType, filename string, fileData []byte) bool {
+	if err := s.scanUpload(r.Context(), fileData); err != nil {
+		writeUploadError(w, op, err)
+		return false
+	}
+
+	detected := sniffMimeType(fileData)
+	if err := s.checkFileTypeMime(fileType, detected); err != nil {
+		writeUploadError(w, op, err)
+		return false
+	}
+	mimeType := storedMimeType(fileType, detected)
+	size, err := s.checkImageUpload(fileType, mimeType, fileData)
+	if err != nil {
+		writeUploadError(w, op, err)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	fileID, err := s.saveRegistrationFile(ctx, registrationID, fileType, filename, mimeType, fileData, size)
+	if err != nil {
+		if errors.Is(err, errRegistrationNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+			return false
+		}
+		var quotaErr *storageQuotaError
+		if errors.As(err, &quotaErr) {
+			writeStorageQuotaError(w, quotaErr)
+			return false
+		}
+		writeServerError(w, r, op+" save", err)
+		return false
+	}
+	s.observeUpload(op, fileType, len(fileData))
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status":  "uploaded",
+		"file_id": fileID.String(),
+	})
+	return true
+}
+
+// fileSubresources are the segments served under /registration-files/{id}.
+var fileSubresources = []string{"downloads", "signed-url"}
+
+func (s *server) registrationFileHandler(w http.ResponseWriter, r *http.Request) {
+	parts, ok := routeSegments(w, r, 3)
+	if !ok {
+		return
+	}
+	if len(parts) < 2 || parts[0] != "registration-files" {
+		notFoundHandler(w, r)
+		return
+	}
+
+	fileID, err := uuid.Parse(parts[1])
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_file_id"})
+		return
+	}
+
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "signed-url":
+			switch r.Method {
+			case http.MethodPost:
+				if !s.requireAPIKey(w, r) {
+					return
+				}
+				s.signDownloadHandler(w, r, fileID.String(), "/registration-files/"+fileID.String())
+			case http.MethodOptions:
+				writeOptions(w, "POST, OPTIONS")
+			default:
+				writeMethodNotAllowed(w, "POST, OPTIONS")
+			}
+		case "downloads":
+			switch r.Method {
+			case http.MethodGet:
+				if !s.requireAPIKey(w, r) {
+					return
+				}
+				s.fileDownloadsHandler(w, r, fileID)
+			case http.MethodOptions:
+				writeOptions(w, "GET, OPTIONS")
+			default:
+				writeMethodNotAllowed(w, "GET, OPTIONS")
+			}
+		default:
+			writeUnknownSubresource(w, r, parts[2], fileSubresources)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.downloadRegistrationFileHandler(w, r, fileID, uuid.Nil)
+	case http.MethodPut:
+		if !s.requireAPIKey(w, r) {
+			return
+		}
+		s.replaceRegistrationFileHandler(w, r, fileID)
+	case http.MethodDelete:
+		if !s.requireAPIKey(w, r) {
+			return
+		}
+		s.deleteRegistrationFileHandler(w, r, fileID)
+	case http.MethodOptions:
+		writeOptions(w, "GET, PUT, DELETE, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, PUT, DELETE, OPTIONS")
+	}
+}
+
+func (s *server) replaceRegistrationFileHandler(w http.ResponseWriter, r *http.Request, fileID uuid.UUID) {
+	log.Printf("replaceRegistrationFile start: fileID=%s method=%s remote=%s", fileID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPut {
+		writeMethodNotAllowed(w, "GET, PUT, DELETE, OPTIONS")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
+	}
+
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	defer removeUploadTempFiles(r)
+	if err := s.parseUploadForm(w, r, maxUploadSize); err != nil {
+		log.Printf("replaceRegistrationFile parse form failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+		return
+	}
+
+	fileData, header, err := readUploadFile(r, "file", maxUploadSize)
+	if err != nil {
+		writeUploadError(w, "replaceRegistrationFile", err)
+		return
+	}
+
+	if err := s.scanUpload(r.Context(), fileData); err != nil {
+		writeUploadError(w, "replaceRegistrationFile", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	fileType, err := s.updateRegistrationFile(ctx, fileID, header.Filename, fileData)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
+			return
+		}
+		if errors.Is(err, errFileDeleted) {
+			w.WriteHeader(http.StatusGone)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_deleted"})
+			return
+		}
+		var quotaErr *storageQuotaError
+		if errors.As(err, &quotaErr) {
+			writeStorageQuotaError(w, quotaErr)
+			return
+		}
+		var ue *uploadError
+		if errors.As(err, &ue) {
+			writeUploadError(w, "replaceRegistrationFile", err)
+			return
+		}
+		writeServerError(w, r, "replaceRegistrationFile update", err)
+		return
+	}
+	s.observeUpload("replaceRegistrationFile", fileType, len(fileData))
+
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status":  "replaced",
+		"file_id": fileID.String(),
+	})
+}
+
+func (s *server) deleteRegistrationFileHandler(w http.ResponseWriter, r *http.Request, fileID uuid.UUID) {
+	log.Printf("deleteRegistrationFile start: fileID=%s method=%s remote=%s", fileID.String(), r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := s.softDeleteRegistrationFile(ctx, fileID); err != nil {
+		if errors.Is(err, errFileNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
+			return
+		}
+		if errors.Is(err, errFileDeleted) {
+			w.WriteHeader(http.StatusGone)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_deleted"})
+			return
+		}
+		writeServerError(w, r, "deleteRegistrationFile delete", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"status":  "deleted",
+		"file_id": fileID.String(),
+	})
+}
+
+// fileDownloadsHandler serves GET /registration-files/{id}/downloads: the
+// file's download_count and its downloads per UTC day over the last ?days=
+// days (default 30, at most 366).
+func (s *server) fileDownloadsHandler(w http.ResponseWriter, r *http.Request, fileID uuid.UUID) {
+	log.Printf("fileDownloads start: fileID=%s method=%s remote=%s", fileID.String(), r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	days := 30
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 366 {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_days"})
+			return
+		}
+		days = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	fd, err := s.getFileDownloads(ctx, fileID, days)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
+			return
+		}
+		writeServerError(w, r, "fileDownloads fetch", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(fd)
+}
+
+// downloadRegistrationFileHandler serves a file's bytes. A non-nil owner
+// (the nested /registrations/{id}/files/{fileId} route) must match the file's
+// registration, otherwise the file is reported as not found.
+func (s *server) downloadRegistrationFileHandler(w http.ResponseWriter, r *http.Request, fileID, owner uuid.UUID) {
+	log.Printf("downloadRegistrationFile start: fileID=%s method=%s remote=%s", fileID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, PUT, DELETE, OPTIONS")
+		return
+	}
+
+	if !s.authorizeDownload(w, r, fileID.String()) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.DownloadFetchTimeout)
+	defer cancel()
+
+	rf, err := s.getRegistrationFile(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, errFileNotFound) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
+			return
+		}
+		if errors.Is(err, errFileDeleted) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_deleted"})
+			return
+		}
+		writeServerError(w, r, "downloadRegistrationFile fetch", err)
+		return
+	}
+
+	if owner != uuid.Nil && rf.RegistrationID != owner {
+		log.Printf("downloadRegistrationFile: file_id=%s belongs to registration=%s, not %s", fileID.String(), rf.RegistrationID.String(), owner.String())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
+		return
+	}
+
+	if len(rf.Data) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_not_found"})
+		return
+	}
+
+	if !checkDownloadIntegrity(w, r, "downloadRegistrationFile", rf.Data, rf.ContentHash) {
+		return
+	}
+
+	body := bufio.NewReaderSize(bytes.NewReader(rf.Data), sniffLen)
+
+	// New rows carry the type detected at upload; legacy rows, and rows
+	// stored as a generic octet-stream, are re-resolved from the first
+	// sniffLen bytes and the filename.
+	var contentType string
+	if rf.MimeType != nil && *rf.MimeType != "" && *rf.MimeType != "application/octet-stream" {
+		contentType = *rf.MimeType
+	} else {
+		head, _ := body.Peek(sniffLen)
+		contentType = resolveMimeType(rf.FileType, rf.Filename, head)
+	}
+
+	s.startTransfer(w, "downloadRegistrationFile")
+	if prefersInlineJSON(r, contentType) {
+		if !s.writeInlineFile(w, "downloadRegistrationFile", inlineFile{
+			FileID:   rf.FileID.String(),
+			Filename: rf.Filename,
+			MimeType: contentType,
+		}, rf.Data) {
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", contentDisposition(r, rf.Filename))
+		w.Header().Add("Vary", "Accept")
+		if rf.FileSize > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(rf.FileSize, 10))
+		}
+
+		w.WriteHeader(http.StatusOK)
+		if _, err := io.Copy(w, body); err != nil {
+			s.logTransferError(r, "downloadRegistrationFile", err)
+			return
+		}
+	}
+
+	// Counted inline so graceful shutdown waits for the UPDATE like any other
+	// handler work. The body is flushed first so the client isn't held up,
+	// and a client that hangs up now still gets its download counted.
+	_ = http.NewResponseController(w).Flush()
+	countCtx, cancelCount := context.WithTimeout(context.WithoutCancel(r.Context()), 2*time.Second)
+	defer cancelCount()
+	if err := s.incrementDownloadCount(countCtx, rf.FileID); err != nil {
+		log.Printf("downloadRegistrationFile count increment failed: file_id=%s err=%v", rf.FileID.String(), err)
+	}
+}
+
+// userSubresources are the segments served under /users/{id}.
+var userSubresources = []string{"cv", "cvs"}
+
+// cvSubresources are the segments served under /users/{id}/cv.
+var cvSubresources = []string{"history", "info", "signed-url"}
+
+func (s *server) userCVHandler(w http.ResponseWriter, r *http.Request) {
+	parts, ok := routeSegments(w, r, 5)
+	if !ok {
+		return
+	}
+	if len(parts) < 3 || parts[0] != "users" {
+		notFoundHandler(w, r)
+		return
+	}
+
+	userID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_user_id"})
+		return
+	}
+
+	if !slices.Contains(userSubresources, parts[2]) {
+		writeUnknownSubresource(w, r, parts[2], userSubresources)
+		return
+	}
+
+	if parts[2] == "cvs" {
+		if len(parts) != 3 {
+			notFoundHandler(w, r)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			s.listUserCVsHandler(w, r, userID)
+		case http.MethodOptions:
+			writeOptions(w, "GET, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "GET, OPTIONS")
+		}
+		return
+	}
+
+	if len(parts) >= 4 && !slices.Contains(cvSubresources, parts[3]) {
+		writeUnknownSubresource(w, r, parts[3], cvSubresources)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "history" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "DELETE, OPTIONS")
+			return
+		}
+		if r.Method != http.MethodDelete {
+			writeMethodNotAllowed(w, "DELETE, OPTIONS")
+			return
+		}
+		if !s.requireAPIKey(w, r) {
+			return
+		}
+		if len(parts) == 4 {
+			s.clearCVHistoryHandler(w, r, userID)
+			return
+		}
+		versionID, err := uuid.Parse(parts[4])
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_version_id"})
+			return
+		}
+		s.deleteCVHistoryEntryHandler(w, r, userID, versionID)
+		return
+	}
+
+	if len(parts) == 4 && parts[3] == "signed-url" {
+		switch r.Method {
+		case http.MethodPost:
+			if !s.requireAPIKey(w, r) {
+				return
+			}
+			s.signDownloadHandler(w, r, cvDownloadResource(userID), fmt.Sprintf(cvDownloadPathTemplate, userID))
+		case http.MethodOptions:
+			writeOptions(w, "POST, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "POST, OPTIONS")
+		}
+		return
+	}
+
+	if len(parts) == 4 && parts[3] == "info" {
+		if r.Method == http.MethodOptions {
+			writeOptions(w, "GET, OPTIONS")
+			return
+		}
+		s.userCVInfoHandler(w, r, userID)
+		return
+	}
+
+	if len(parts) != 3 {
+		notFoundHandler(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		s.downloadUserCVHandler(w, r, userID)
+	case http.MethodPost:
+		s.uploadUserCVHandler(w, r, userID)
+	case http.MethodDelete:
+		if !s.requireAPIKey(w, r) {
+			return
+		}
+		s.purgeUserCVHandler(w, r, userID)
+	case http.MethodOptions:
+		writeOptions(w, "GET, POST, DELETE, OPTIONS")
+	default:
+		log.Printf("userCVHandler invalid method: %s", r.Method)
+		writeMethodNotAllowed(w, "GET, POST, DELETE, OPTIONS")
+	}
+}
+
+// purgeUserCVHandler serves DELETE /users/{id}/cv, the data-erasure path: it
+// removes the CV, its history and derived data and records an audit entry.
+func (s *server) purgeUserCVHandler(w http.ResponseWriter, r *http.Request, userID int64) {
+	log.Printf("purgeUserCV start: userID=%d remote=%s", userID, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	summary, err := s.purgeUserCV(ctx, userID, w.Header().Get("X-Request-ID"))
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return
+		}
+		writeServerError(w, r, "purgeUserCV", err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(summary); err != nil {
+		log.Printf("purgeUserCV encode failed: %v", err)
+	}
+}
+
+func (s *server) userCVInfoHandler(w http.ResponseWriter, r *http.Request, userID int64) {
+	log.Printf("userCVInfo start: userID=%d method=%s remote=%s", userID, r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, OPTIONS")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	info, err := s.getUserCVInfo(ctx, userID)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return
+		}
+		if errors.Is(err, errCVNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "cv_not_found"})
+			return
+		}
+		writeServerError(w, r, "userCVInfo fetch", err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		log.Printf("userCVInfo encode failed: %v", err)
+	}
+}
+
+// listUserCVsHandler serves GET /users/{id}/cvs: the metadata of every CV the
+// user has, primary first.
+func (s *server) listUserCVsHandler(w http.ResponseWriter, r *http.Request, userID int64) {
+	log.Printf("listUserCVs start: userID=%d method=%s remote=%s", userID, r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	cvs, err := s.listUserCVs(ctx, userID)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return
+		}
+		writeServerError(w, r, "listUserCVs fetch", err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(cvs); err != nil {
+		log.Printf("listUserCVs encode failed: %v", err)
+	}
+}
+
+func (s *server) deleteCVHistoryEntryHandler(w http.ResponseWriter, r *http.Request, userID int64, versionID uuid.UUID) {
+	log.Printf("deleteCVHistoryEntry start: userID=%d versionID=%s remote=%s", userID, versionID.String(), r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := s.deleteCVHistoryEntry(ctx, userID, versionID); err != nil {
+		if errors.Is(err, errCVVersionNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "cv_version_not_found"})
+			return
+		}
+		writeServerError(w, r, "deleteCVHistoryEntry delete", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]int64{"removed": 1})
+}
+
+func (s *server) clearCVHistoryHandler(w http.ResponseWriter, r *http.Request, userID int64) {
+	log.Printf("clearCVHistory start: userID=%d remote=%s", userID, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	removed, err := s.clearCVHistory(ctx, userID)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return
+		}
+		writeServerError(w, r, "clearCVHistory delete", err)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]int64{"removed": removed})
+}
+
+func (s *server) uploadUserCVHandler(w http.ResponseWriter, r *http.Request, userID int64) {
+	log.Printf("uploadUserCV start: userID=%d method=%s remote=%s", userID, r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
+	}
+
+	// the slot is taken first so a burst of uploads can't each hold a
+	// database connection for the limit lookup while waiting for one
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	limitCtx, cancelLimit := context.WithTimeout(r.Context(), 5*time.Second)
+	limit, err := s.cvUploadLimit(limitCtx, userID)
+	cancelLimit()
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return
+		}
+		writeServerError(w, r, "uploadUserCV limit", err)
+		return
+	}
+
+	defer removeUploadTempFiles(r)
+	if err := s.parseUploadForm(w, r, limit); err != nil {
+		log.Printf("uploadUserCV parse form failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_form"})
+		return
+	}
+
+	// primary=false adds another CV instead of replacing the primary one
+	primary := true
+	if v := strings.TrimSpace(r.FormValue("primary")); v != "" {
+		if primary, err = strconv.ParseBool(v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_primary"})
+			return
+		}
+	}
+
+	cvData, header, err := readUploadFile(r, "file", limit)
+	if err != nil {
+		writeUploadError(w, "uploadUserCV", err)
+		return
+	}
+
+	s.storeUserCV(w, r, "uploadUserCV", userID, header.Filename, header.Header.Get("Content-Type"), cvData, !primary)
+}
+
+// storeUserCV scans, validates and saves uploaded CV bytes, then writes the
+// 201, a 200 "unchanged" when the bytes match the current CV, or the
+// rejection. A part the client declared as application/pdf is accepted even
+// when sniffing disagrees; its page count is then usually unknown. It
+// reports whether the upload was accepted.
+func (s *server) storeUserCV(w http.ResponseWriter, r *http.Request, op string, userID int64, filename, declaredType string, cvData []byte, additional bool) bool {
+	if err := s.scanUpload(r.Context(), cvData); err != nil {
+		writeUploadError(w, op, err)
+		return false
+	}
+
+	mimeType := http.DetectContentType(cvData)
+	if mimeType != "application/pdf" && declaredType != "application/pdf" {
+		log.Printf("%s invalid mime type: detected=%s header=%s", op, mimeType, declaredType)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_file_type"})
+		return false
+	}
+	mimeType = "application/pdf"
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	pageCount := countPDFPages(cvData)
+	if pageCount == nil {
+		log.Printf("%s could not determine page count for user=%d", op, userID)
+	}
+
+	unlock := s.cvLocks.lock(uint64(userID))
+	cvID, changed, err := s.saveUserCV(ctx, userID, cvData, filename, mimeType, pageCount, additional)
+	unlock()
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return false
+		}
+		writeServerError(w, r, op+" save", err)
+		return false
+	}
+	s.observeUpload(op, "cv", len(cvData))
+
+	if !changed {
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "unchanged", "cv_id": cvID.String()})
+		return true
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "uploaded", "cv_id": cvID.String()})
+	return true
+}
+
+func (s *server) downloadUserCVHandler(w http.ResponseWriter, r *http.Request, userID int64) {
+	log.Printf("downloadUserCV start: userID=%d method=%s remote=%s", userID, r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, POST, OPTIONS")
+		return
+	}
+
+	if !s.authorizeDownload(w, r, cvDownloadResource(userID)) {
+		return
+	}
+
+	// ?cv_id= picks one of the user's CVs; without it the primary is served
+	var cvID uuid.UUID
+	if v := r.URL.Query().Get("cv_id"); v != "" {
+		var err error
+		if cvID, err = uuid.Parse(v); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_cv_id"})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.cfg.DownloadFetchTimeout)
+	defer cancel()
+
+	cv, err := s.getUserCV(ctx, userID, cvID)
+	if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+			return
+		}
+		if errors.Is(err, errCVNotFound) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "cv_not_found"})
+			return
+		}
+		writeServerError(w, r, "downloadUserCV fetch", err)
+		return
+	}
+
+	if len(cv.Data) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "cv_not_found"})
+		return
+	}
+
+	if !checkDownloadIntegrity(w, r, "downloadUserCV", cv.Data, cv.Hash) {
+		return
+	}
+
+	s.startTransfer(w, "downloadUserCV")
+	if prefersInlineJSON(r, cv.MimeType) {
+		s.writeInlineFile(w, "downloadUserCV", inlineFile{
+			FileID:   cv.CVID.String(),
+			Filename: cv.Filename,
+			MimeType: cv.MimeType,
+		}, cv.Data)
+		return
+	}
+
+	w.Header().Set("Content-Type", cv.MimeType)
+	w.Header().Set("Content-Disposition", contentDisposition(r, cv.Filename))
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(cv.Data); err != nil {
+		s.logTransferError(r, "downloadUserCV", err)
+	}
+}
+
+var pdfPageObject = regexp.MustCompile(`/Type\s*/Page\b`)
+
+// countPDFPages counts page objects in an uncompressed PDF body. It returns nil
+// for anything it can't make sense of (missing trailer, pages inside object
+// streams), which callers store as unknown rather than failing.
+func countPDFPages(data []byte) *int {
+	if !bytes.HasPrefix(data, []byte("%PDF-")) || !bytes.Contains(data, []byte("%%EOF")) {
+		return nil
+	}
+
+	n := len(pdfPageObject.FindAllIndex(data, -1))
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+// normalizeFileType is the canonical form of a file_type: trimmed and
+// lowercased, so "Passport" and " PASSPORT " are stored, matched against
+// FILE_TYPE_MIME_TYPES and filtered on as "passport".
+func normalizeFileType(v string) string {
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+func writeMissingFormField(w http.ResponseWriter, r *http.Request, field, code string) {
+	body := map[string]string{"error": code}
+	if similar := similarFormField(r, field); similar != "" {
+		log.Printf("missing form field %s, got similar %q", field, similar)
+		body["expected_field"] = field
+		body["received_field"] = similar
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// similarFormField looks for a submitted multipart field whose name is a
+// likely typo of want, and returns it, or "" when nothing is close. Names
+// match when they differ only in case and separators ("File", "fileType",
+// "registration-id") or by a single edit after that ("fle", "files").
+func similarFormField(r *http.Request, want string) string {
+	if r.MultipartForm == nil {
+		return ""
+	}
+
+	var names []string
+	for name := range r.MultipartForm.Value {
+		names = append(names, name)
+	}
+	for name := range r.MultipartForm.File {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	target := canonicalFieldName(want)
+	for _, name := range names {
+		if name == want {
+			continue
+		}
+		if got := canonicalFieldName(name); editDistance(got, target) <= 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+func canonicalFieldName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func writeStorageQuotaError(w http.ResponseWriter, err *storageQuotaError) {
+	w.WriteHeader(http.StatusConflict)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":       "storage_quota_exceeded",
+		"usage_bytes": err.Usage,
+		"limit_bytes": err.Limit,
+	})
+}
+
+// defaultWhatsappCountryCode is assumed for numbers written in local format
+// (leading 0), which is how most of our applicants enter them.
+const defaultWhatsappCountryCode = "62"
+
+// normalizeWhatsappNumber converts a user-entered phone number to E.164
+// (e.g. "0812-3456-789" -> "+628123456789").
+func normalizeWhatsappNumber(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+
+	var digits strings.Builder
+	for i, c := range raw {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c == '+' && i == 0:
+		case c == ' ' || c == '-' || c == '.' || c == '(' || c == ')':
+		default:
+			return "", false
+		}
+	}
+
+	d := digits.String()
+	switch {
+	case strings.HasPrefix(raw, "+"):
+	case strings.HasPrefix(d, "00"):
+		d = d[2:]
+	case strings.HasPrefix(d, "0"):
+		d = defaultWhatsappCountryCode + d[1:]
+	}
+
+	// E.164 allows at most 15 digits; anything under 8 can't be a mobile number.
+	if len(d) < 8 || len(d) > 15 || d[0] == '0' {
+		return "", false
+	}
+	return "+" + d, true
+}
+
+// uploadError is a client-facing upload validation failure. When a required
+// field is missing but a similarly named one was sent, expected/received
+// carry both names so the client can spot the typo.
+type uploadError struct {
+	status   int
+	code     string
+	expected string
+	received string
+	details  map[string]any
+}
+
+func (e *uploadError) Error() string { return e.code }
+
+// acquireUploadSlot bounds how many uploads buffer file bytes at once. It
+// waits up to UploadSlotWait for a slot, then answers 503 server_busy. Once
+// shutdown has begun it answers 503 shutting_down straight away.
+func (s *server) acquireUploadSlot(w http.ResponseWriter, r *http.Request) (release func(), ok bool) {
+	if !s.uploads.begin() {
+		log.Printf("upload rejected: shutting down, remote=%s", r.RemoteAddr)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "shutting_down"})
+		return nil, false
+	}
+
+	if s.uploadSlots == nil {
+		return s.uploads.end, true
+	}
+
+	timer := time.NewTimer(s.cfg.UploadSlotWait)
+	defer timer.Stop()
+
+	select {
+	case s.uploadSlots <- struct{}{}:
+		return func() {
+			<-s.uploadSlots
+			s.uploads.end()
+		}, true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	s.uploads.end()
+
+	log.Printf("upload rejected: %d uploads in flight, remote=%s", cap(s.uploadSlots), r.RemoteAddr)
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(s.cfg.UploadSlotWait.Seconds()))))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "server_busy"})
+	return nil, false
+}
+
+// parseUploadForm parses a multipart upload of at most limit bytes. Parts
+// beyond MULTIPART_MEMORY_BYTES are spilled to temp files instead of the heap;
+// callers defer removeUploadTempFiles so those go away on every path.
+func (s *server) parseUploadForm(w http.ResponseWriter, r *http.Request, limit int64) error {
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1024)
+	return r.ParseMultipartForm(s.cfg.MultipartMemory)
+}
+
+// removeUploadTempFiles deletes any temp files backing r's multipart form.
+func removeUploadTempFiles(r *http.Request) {
+	if r.MultipartForm == nil {
+		return
+	}
+	if err := r.MultipartForm.RemoveAll(); err != nil {
+		log.Printf("removeUploadTempFiles: %v", err)
+	}
+}
+
+// readUploadFile reads a multipart file field fully, enforcing limit.
+// Validation failures are returned as *uploadError.
+func readUploadFile(r *http.Request, field string, limit int64) ([]byte, *multipart.FileHeader, error) {
+	file, header, err := r.FormFile(field)
+	if err != nil {
+		log.Printf("readUploadFile missing %s: %v", field, err)
+		return nil, nil, &uploadError{
+			status:   http.StatusBadRequest,
+			code:     "file_required",
+			expected: field,
+			received: similarFormField(r, field),
+		}
+	}
+	defer file.Close()
+
+	tooLarge := &uploadError{
+		status:  http.StatusBadRequest,
+		code:    "file_too_large",
+		details: map[string]any{"limit_bytes": limit},
+	}
+
+	if header.Size > limit {
+		log.Printf("readUploadFile file too large: %d bytes", header.Size)
+		return nil, nil, tooLarge
+	}
+
+	buf := bytes.NewBuffer(nil)
+	n, err := io.Copy(buf, io.LimitReader(file, limit+1))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n > limit {
+		log.Printf("readUploadFile exceeded limit during read: %d bytes", n)
+		return nil, nil, tooLarge
+	}
+
+	if n == 0 {
+		return nil, nil, &uploadError{status: http.StatusBadRequest, code: "empty_file"}
+	}
+
+	return buf.Bytes(), header, nil
+}
+
+func writeUploadError(w http.ResponseWriter, logPrefix string, err error) {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		log.Printf("%s rejected upload: %s", logPrefix, ue.code)
+		body := map[string]any{"error": ue.code}
+		for k, v := range ue.details {
+			body[k] = v
+		}
+		if ue.received != "" {
+			body["expected_field"] = ue.expected
+			body["received_field"] = ue.received
+		}
+		w.WriteHeader(ue.status)
+		_ = json.NewEncoder(w).Encode(body)
+		return
+	}
+	log.Printf("%s read failed: %v", logPrefix, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+}
+
+// fileTypeDefaultMimeTypes is used when content sniffing can't tell what a
+// registration file is, based on what each document category is expected to be.
+var fileTypeDefaultMimeTypes = map[string]string{
+	"photo":    "image/jpeg",
+	"passport": "application/pdf",
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// magicMimeTypes catch formats http.DetectContentType misses: PDFs whose
+// "%PDF-" header sits after a BOM or leading junk (readers accept it
+// anywhere in the first KB; we only see sniffLen bytes) and HEIC photos.
+// Uploads only trust the fixed-offset entries.
+var magicMimeTypes = []struct {
+	magic    []byte
+	offset   int // -1: anywhere in the sniffed bytes (downloads only)
+	mimeType string
+}{
+	{[]byte("%PDF-"), -1, "application/pdf"},
+	{[]byte("ftypheic"), 4, "image/heic"},
+	{[]byte("ftypheix"), 4, "image/heic"},
+	{[]byte("ftypmif1"), 4, "image/heif"},
+}
+
+// extensionMimeTypes is the last resort before the file_type default, for
+// content that sniffs as generic.
+var extensionMimeTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".heic": "image/heic",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// genericMimeType reports whether http.DetectContentType gave up on data.
+func genericMimeType(detected string) bool {
+	return detected == "application/octet-stream" || strings.HasPrefix(detected, "text/plain")
+}
+
+// sniffMimeType is what an upload's bytes say they are: content sniffing,
+// then the magic-byte entries anchored at a fixed offset. It never looks at
+// the client's filename, so it is what uploads are validated against.
+func sniffMimeType(data []byte) string {
+	head := data[:min(len(data), sniffLen)]
+	detected := http.DetectContentType(head)
+	if !genericMimeType(detected) {
+		return detected
+	}
+	for _, m := range magicMimeTypes {
+		if m.offset >= 0 && bytes.HasPrefix(head[min(len(head), m.offset):], m.magic) {
+			return m.mimeType
+		}
+	}
+	return detected
+}
+
+// storedMimeType is the type an upload is stored as: the sniffed type, or
+// the file_type default when sniffing couldn't tell. Validation has to look
+// at detected itself, or the default would vouch for any unknown file.
+func storedMimeType(fileType, detected string) string {
+	if !genericMimeType(detected) {
+		return detected
+	}
+	if def, ok := fileTypeDefaultMimeTypes[strings.ToLower(fileType)]; ok {
+		return def
+	}
+	return detected
+}
+
+// resolveMimeType picks the type a stored file is served as when the row
+// doesn't carry a usable one: content sniffing first, then the magic-byte
+// table, the filename extension and finally the file_type default. Only
+// downloads use it; it trusts the filename too much to validate uploads.
+func resolveMimeType(fileType, filename string, data []byte) string {
+	head := data[:min(len(data), sniffLen)]
+	detected := http.DetectContentType(head)
+	generic := genericMimeType(detected)
+	// office documents are zip containers; only the extension tells them apart
+	if !generic && detected != "application/zip" {
+		return detected
+	}
+
+	if generic {
+		for _, m := range magicMimeTypes {
+			if m.offset < 0 && bytes.Contains(head, m.magic) ||
+				m.offset >= 0 && bytes.HasPrefix(head[min(len(head), m.offset):], m.magic) {
+				return m.mimeType
+			}
+		}
+	}
+	if mimeType, ok := extensionMimeTypes[strings.ToLower(path.Ext(filename))]; ok {
+		return mimeType
+	}
+	if !generic {
+		return detected
+	}
+	if def, ok := fileTypeDefaultMimeTypes[strings.ToLower(fileType)]; ok {
+		return def
+	}
+	return detected
+}
+
+// checkFileTypeMime rejects a file whose detected type doesn't belong to its
+// declared file_type, such as a PDF sent as a photo. Rejections are returned
+// as *uploadError.
+func (s *server) checkFileTypeMime(fileType, mimeType string) error {
+	allowed, ok := s.cfg.FileTypeMimeTypes[strings.ToLower(fileType)]
+	if !ok {
+		return nil
+	}
+	mediaType, _, _ := strings.Cut(mimeType, ";")
+	if slices.Contains(allowed, strings.ToLower(strings.TrimSpace(mediaType))) {
+		return nil
+	}
+	return &uploadError{
+		status: http.StatusBadRequest,
+		code:   "file_type_mismatch",
+		details: map[string]any{
+			"declared_file_type": fileType,
+			"detected_mime_type": mimeType,
+			"allowed_mime_types": allowed,
+		},
+	}
+}
+
+// mimeExtensions picks the conventional extension where mime.ExtensionsByType
+// would return several (image/jpeg also maps to .jfif, .jpe).
+var mimeExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+}
+
+// fallbackFilename names an upload whose multipart header carried no
+// filename, e.g. "photo-<file_id>.jpg".
+func fallbackFilename(fileType string, fileID uuid.UUID, mimeType string) string {
+	base, _, _ := strings.Cut(mimeType, ";")
+	ext, ok := mimeExtensions[base]
+	if !ok {
+		ext = ".bin"
+		if exts, err := mime.ExtensionsByType(base); err == nil && len(exts) > 0 {
+			ext = exts[0]
+		}
+	}
+	return strings.ToLower(fileType) + "-" + fileID.String() + ext
+}
+
+// decodeJSONBody decodes the request body into v. On failure it answers 400
+// invalid_json with a detail saying where the body went wrong and returns
+// false.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, logPrefix string, v any) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil {
+		return true
+	}
+	writeDecodeError(w, logPrefix, err)
+	return false
+}
+
+// decodeJSONArray decodes a JSON array body one element at a time and stops
+// with 413 batch_too_large as soon as it holds more than max items, so an
+// oversized batch is refused without decoding the rest of it. A null body
+// decodes to an empty slice.
+func decodeJSONArray[T any](w http.ResponseWriter, r *http.Request, logPrefix string, max int) ([]T, bool) {
+	dec := json.NewDecoder(r.Body)
+	tok, err := dec.Token()
+	if err != nil {
+		writeDecodeError(w, logPrefix, err)
+		return nil, false
+	}
+	if tok == nil {
+		return nil, true
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '[' {
+		log.Printf("%s decode failed: body is not a JSON array", logPrefix)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_json", "detail": "request body must be a JSON array"})
+		return nil, false
+	}
+
+	items := make([]T, 0)
+	for dec.More() {
+		if len(items) == max {
+			log.Printf("%s batch too large: more than %d items", logPrefix, max)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "batch_too_large", "max": max})
+			return nil, false
+		}
+		var item T
+		if err := dec.Decode(&item); err != nil {
+			writeDecodeError(w, logPrefix, err)
+			return nil, false
+		}
+		items = append(items, item)
+	}
+	// the closing bracket; a body cut off before it is malformed, not empty
+	if _, err := dec.Token(); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		writeDecodeError(w, logPrefix, err)
+		return nil, false
+	}
+	return items, true
+}
+
+// writeDecodeError answers a request whose JSON body failed to decode with
+// 400, describing where and why when the decoder says.
+func writeDecodeError(w http.ResponseWriter, logPrefix string, err error) {
+	log.Printf("%s decode failed: %v", logPrefix, err)
+
+	// nothing but whitespace: a missing body, not malformed JSON
+	if errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "empty_body"})
+		return
+	}
+
+	body := map[string]any{"error": "invalid_json"}
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.As(err, &syntaxErr):
+		body["detail"] = syntaxErr.Error()
+		body["offset"] = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		body["detail"] = typeErr.Error()
+		body["offset"] = typeErr.Offset
+		if typeErr.Field != "" {
+			body["field"] = typeErr.Field
+			logValidationRejections(logPrefix, validationErrors{typeErr.Field: "invalid_type"})
+		}
+		body["expected_type"] = typeErr.Type.String()
+		body["received_type"] = typeErr.Value
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		body["detail"] = "request body ends in the middle of a JSON value"
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// writeServerError reports a failed backend call and logs it under op.
+// A client that already went away gets no response and only a quiet log line;
+// deadline overruns get 504, constraint violations the client error
+// classifyConstraintViolation picks, anything else is logged as a real
+// failure and gets 500.
+func writeServerError(w http.ResponseWriter, r *http.Request, op string, err error) {
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		log.Printf("%s canceled: client disconnected", op)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ce, ok := classifyConstraintViolation(err); ok {
+		log.Printf("%s %s on %s", op, ce.Code, ce.Field)
+		w.WriteHeader(ce.Status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": ce.Code, "field": ce.Field})
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("%s timed out: %v", op, err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "request_timeout"})
+		return
+	}
+
+	log.Printf("%s failed: %v", op, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "internal_error"})
+}
+
+// startTransfer gives the response body DOWNLOAD_TRANSFER_TIMEOUT to reach
+// the client, counted from now, so a large file isn't held to the budget the
+// database fetch had and a stalled client can't hold the connection forever.
+func (s *server) startTransfer(w http.ResponseWriter, op string) {
+	if s.cfg.DownloadTransferTimeout <= 0 {
+		return
+	}
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(s.cfg.DownloadTransferTimeout)); err != nil {
+		log.Printf("%s could not set write deadline: %v", op, err)
+	}
+}
+
+// logTransferError logs a body write that failed part way. A client that hung
+// up is routine and gets a quiet line, like in writeServerError.
+func (s *server) logTransferError(r *http.Request, op string, err error) {
+	switch {
+	case errors.Is(r.Context().Err(), context.Canceled),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, syscall.ECONNRESET):
+		log.Printf("%s canceled: client disconnected", op)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		log.Printf("%s transfer timed out after %s", op, s.cfg.DownloadTransferTimeout)
+	default:
+		log.Printf("%s write failed: %v", op, err)
+	}
+}
+
+// contentDisposition returns an attachment disposition unless the client asked
+// for ?disposition=inline, e.g. to preview a PDF in the browser.
+func contentDisposition(r *http.Request, filename string) string {
+	disposition := "attachment"
+	if r.URL.Query().Get("disposition") == "inline" {
+		disposition = "inline"
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"", disposition, filename)
+}
+
+func (s *server) buildDownloadURL(r *http.Request, userID int64) string {
+	return s.publicURL(r, fmt.Sprintf(cvDownloadPathTemplate, userID))
+}
+
+// publicURL makes an absolute URL for an API path, on the same base path and
+// API version the request came in on.
+func (s *server) publicURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s", scheme, r.Host)
+	if strings.HasPrefix(serviceHost, "http://") || strings.HasPrefix(serviceHost, "https://") {
+		base = serviceHost
+	}
+	prefix := s.cfg.BasePath
+	if v := apiVersion(r); v != "" {
+		prefix += "/" + v
+	}
+	return base + prefix + path
+}
+
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("ping request: method=%s remote=%s", r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := map[string]string{
+		"message":     "pong v2",
+		"version":     version,
+		"server_time": time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		// Best-effort error response if encoding fails
+		http.Error(w, `{"error":"internal_error"}`, http.StatusInternalServerError)
+	}
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("version request: method=%s remote=%s", r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	resp := map[string]any{
+		"version":      version,
+		"commit":       commit,
+		"build_time":   buildTime,
+		"api_versions": supportedAPIVersions,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, `{"error":"internal_error"}`, http.StatusInternalServerError)
+	}
+}
+
+// rootHandler answers the bare domain with a small service descriptor, so a
+// browser pointed at the service shows something other than a 404.
+func (s *server) rootHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeMethodNotAllowed(w, "GET, HEAD")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	resp := map[string]any{
+		"name":    s.cfg.ServiceName,
+		"version": version,
+		"links": map[string]string{
+			"healthz": "/healthz",
+			"version": "/version",
+			"api":     s.cfg.BasePath + "/v1",
+		},
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("root encode failed: %v", err)
+	}
+}
+
+// healthzHandler reports whether this instance's schema matches the
+// migrations it was built with. It answers 503 while any are pending so
+// deploys can hold traffic until the schema catches up.
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	applied, err := appliedSchemaVersion(ctx, s.db)
+	if err != nil {
+		log.Printf("healthz: schema version check failed: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"status": "unavailable", "error": "database_unavailable"})
+		return
+	}
+
+	expected := len(migrations)
+	resp := map[string]any{
+		"status":           "ok",
+		"schema_version":   applied,
+		"expected_version": expected,
+		"pending":          max(0, expected-applied),
+	}
+	if applied < expected {
+		resp["status"] = "migrations_pending"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// writeOptions answers an OPTIONS request with the methods the route supports.
+func writeOptions(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeMethodNotAllowed answers 405 with the Allow header RFC 9110 requires.
+func writeMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "method_not_allowed"})
+}
+
+// notFoundHandler echoes the attempted method and path so integrators can spot
+// a mistyped route. The path is the one the client sent (before any prefix
+// stripping), without the query string, and capped in length.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("not found: path=%s method=%s remote=%s", r.URL.Path, r.Method, r.RemoteAddr)
+
+	path, _, _ := strings.Cut(r.RequestURI, "?")
+	if path == "" {
+		path = r.URL.Path
+	}
+	const maxEchoedPath = 256
+	if len(path) > maxEchoedPath {
+		path = path[:maxEchoedPath]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":  "not_found",
+		"method": r.Method,
+		"path":   path,
+	})
+}
+
+// routeSegments splits the path for the manual routers. Paths deeper than
+// max segments can't match anything, so they get 404 path_too_deep before
+// any segment is parsed.
+func routeSegments(w http.ResponseWriter, r *http.Request, max int) ([]string, bool) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) <= max {
+		return parts, true
+	}
+
+	log.Printf("path too deep: segments=%d max=%d method=%s remote=%s", len(parts), max, r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(map[string]any{"error": "path_too_deep", "max_segments": max})
+	return nil, false
+}
+
+// writeUnknownSubresource answers 404 for a well-formed id followed by a
+// segment the router doesn't serve, listing the ones it does so typos like
+// "file" for "files" are easy to spot.
+func writeUnknownSubresource(w http.ResponseWriter, r *http.Request, segment string, available []string) {
+	log.Printf("unknown subresource: path=%s method=%s remote=%s", r.URL.Path, r.Method, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusNotFound)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"error":       "unknown_subresource",
+		"subresource": segment,
+		"available":   available,
+	})
 }
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// newUploadRequest builds a multipart POST carrying fields and data as the
+// "file" part.
+func newUploadRequest(t *testing.T, target string, fields map[string]string, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatalf("write field %s: %v", k, err)
+		}
+	}
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("create form file: %v", err)
+	}
+	if _, err := part.Write(data); err != nil {
+		t.Fatalf("write form file: %v", err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatalf("close multipart: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestConcurrentIdenticalCVUploads(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	name := "CV Tester"
+	user, err := s.insertUser(ctx, createUserRequest{Name: &name})
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	first := []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n")
+	if _, _, err := s.saveUserCV(ctx, user.ID, first, "first.pdf", "application/pdf", nil, false); err != nil {
+		t.Fatalf("seed cv: %v", err)
+	}
+
+	// a double-click: the same new CV twice at once
+	second := []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n2 0 obj << /Type /Page >> endobj\n%%EOF\n")
+	target := "/users/" + strconv.FormatInt(user.ID, 10) + "/cv"
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			s.uploadUserCVHandler(rec, newUploadRequest(t, target, nil, "second.pdf", second), user.ID)
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+
+	if !(codes[0] == http.StatusCreated && codes[1] == http.StatusOK) &&
+		!(codes[0] == http.StatusOK && codes[1] == http.StatusCreated) {
+		t.Errorf("statuses %v, want one 201 uploaded and one 200 unchanged", codes)
+	}
+
+	var entries int
+	if err := s.db.QueryRow(ctx, `SELECT count(*) FROM cv_history WHERE user_id = $1`, user.ID).Scan(&entries); err != nil {
+		t.Fatalf("count history: %v", err)
+	}
+	if entries != 1 {
+		t.Errorf("%d cv_history entries, want 1", entries)
+	}
+}
+
+// The same double-click against fakePG, which fails any read of the primary
+// CV or write to it made without the user row lock.
+func TestIdenticalCVUploadsReadPrimaryUnderLock(t *testing.T) {
+	const userID = 7
+	lock := "users:" + strconv.Itoa(userID)
+	first := []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n%%EOF\n")
+	second := []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n2 0 obj << /Type /Page >> endobj\n%%EOF\n")
+
+	var (
+		mu          sync.Mutex
+		primaryID   = uuid.New()
+		primaryHash = contentHash(first)
+		history     int
+	)
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	s.db = newFakePG(t, func(sess *fakeSession, query string) fakeResult {
+		switch {
+		case strings.HasPrefix(query, "SELECT 1 FROM users") && strings.HasSuffix(query, "FOR UPDATE"):
+			sess.lockRow(lock)
+			return oneRow(int4Value(1))
+		case !sess.holds(lock):
+			return failed("CV statement without the user row lock: " + query)
+		case strings.Contains(query, "FROM user_cvs WHERE user_id") && strings.Contains(query, "is_primary"):
+			mu.Lock()
+			defer mu.Unlock()
+			return oneRow(uuidValue(primaryID), textValue(primaryHash))
+		case strings.Contains(query, "INSERT INTO cv_history"):
+			sess.afterCommit(func() {
+				mu.Lock()
+				history++
+				mu.Unlock()
+			})
+			return command("INSERT 0 1")
+		case strings.HasPrefix(query, "UPDATE user_cvs"):
+			hash := contentHash(second)
+			if !strings.Contains(query, hash) {
+				return failed("unexpected CV written: " + query)
+			}
+			sess.afterCommit(func() {
+				mu.Lock()
+				primaryHash = hash
+				mu.Unlock()
+			})
+			return command("UPDATE 1")
+		}
+		return failed("unexpected query: " + query)
+	})
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/users/"+strconv.Itoa(userID)+"/cv", nil)
+			s.storeUserCV(rec, req, "uploadUserCV", userID, "second.pdf", "application/pdf", second, false)
+			codes[i] = rec.Code
+		}()
+	}
+	wg.Wait()
+
+	if !(codes[0] == http.StatusCreated && codes[1] == http.StatusOK) &&
+		!(codes[0] == http.StatusOK && codes[1] == http.StatusCreated) {
+		t.Errorf("statuses %v, want one 201 uploaded and one 200 unchanged", codes)
+	}
+	if history != 1 {
+		t.Errorf("%d cv_history entries, want 1", history)
+	}
+}
+
+func TestMalformedNestedPaths(t *testing.T) {
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	routes := s.v1Routes()
+	const id = "6f1c2b3a-0d4e-4f5a-8b6c-7d8e9f0a1b2c"
+
+	tests := []struct {
+		path   string
+		status int
+		code   string
+	}{
+		{"/registrations/" + id + "/file", http.StatusNotFound, "unknown_subresource"},
+		{"/registrations/" + id + "/files/" + id + "/extra", http.StatusNotFound, "path_too_deep"},
+		{"/registrations/not-a-uuid/files", http.StatusBadRequest, "invalid_registration_id"},
+		{"/users/5/cvv", http.StatusNotFound, "unknown_subresource"},
+		{"/users/5/cv/histroy", http.StatusNotFound, "unknown_subresource"},
+		{"/users/5/cv/history/" + id + "/x", http.StatusNotFound, "path_too_deep"},
+		{"/users/abc/cv", http.StatusBadRequest, "invalid_user_id"},
+		{"/registration-files/" + id + "/signed", http.StatusNotFound, "unknown_subresource"},
+		{"/registration-files/" + id + "/signed-url/x", http.StatusNotFound, "path_too_deep"},
+		{"/registration-files/nope", http.StatusBadRequest, "invalid_file_id"},
+		{"/uploads/nope", http.StatusBadRequest, "invalid_upload_id"},
+		{"/uploads/" + id + "/finalize/now", http.StatusNotFound, "path_too_deep"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			var body map[string]any
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("decode body: %v", err)
+			}
+			if body["error"] != tt.code {
+				t.Errorf("error = %v, want %s", body["error"], tt.code)
+			}
+		})
+	}
+}
+
+func TestBulkCreateBatchOneOverLimit(t *testing.T) {
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	s.cfg.BulkRegistrationMax = 3
+
+	item := `{"full_name":"A","whatsapp_number":"08123456789"}`
+	body := "[" + strings.Repeat(item+",", s.cfg.BulkRegistrationMax) + item + "]"
+
+	rec := httptest.NewRecorder()
+	s.bulkCreateRegistrationsHandler(rec, httptest.NewRequest(http.MethodPost, "/registrations/bulk", strings.NewReader(body)))
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rec.Code)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"error":"batch_too_large","max":3}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+// Sample file heads for content-type tests.
+var (
+	samplePDF  = []byte("%PDF-1.4\n1 0 obj << /Type /Catalog >> endobj\n%%EOF\n")
+	samplePNG  = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	sampleJPEG = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+	sampleBlob = []byte{0x00, 0x01, 0x02, 0x03, 0xfe, 0xff}
+)
+
+func TestResolveMimeTypeForDownloads(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileType string
+		filename string
+		data     []byte
+		want     string
+	}{
+		{"pdf bytes", "passport", "scan", samplePDF, "application/pdf"},
+		{"png bytes", "photo", "face", samplePNG, "image/png"},
+		{"jpeg bytes", "photo", "face", sampleJPEG, "image/jpeg"},
+		{"unknown passport bytes use the default", "passport", "scan", sampleBlob, "application/pdf"},
+		{"unknown photo bytes use the default", "photo", "face", sampleBlob, "image/jpeg"},
+		{"pdf header after junk", "other", "doc", append([]byte("\xef\xbb\xbfjunk "), samplePDF...), "application/pdf"},
+		{"pdf extension", "other", "doc.PDF", sampleBlob, "application/pdf"},
+		{"unknown bytes, no hint", "other", "doc", sampleBlob, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveMimeType(tt.fileType, tt.filename, tt.data); got != tt.want {
+				t.Errorf("resolveMimeType = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffMimeTypeIgnoresHints(t *testing.T) {
+	// uploads are validated on content alone: neither a .pdf name nor a
+	// "%PDF-" past the first byte makes a file a PDF
+	if got := sniffMimeType(append([]byte("junk "), samplePDF...)); got == "application/pdf" {
+		t.Errorf("sniffMimeType accepted a PDF header that isn't at offset 0")
+	}
+	if got := storedMimeType("passport", sniffMimeType(sampleBlob)); got != "application/pdf" {
+		t.Errorf("storedMimeType = %q, want the passport default", got)
+	}
+	s := &server{cfg: loadConfig()}
+	if err := s.checkFileTypeMime("passport", sniffMimeType([]byte("just some text"))); err == nil {
+		t.Errorf("text declared as passport passed the MIME check")
+	}
+}
+
+func TestDownloadContentType(t *testing.T) {
+	s := testServer(t)
+	s.cfg.DownloadAuth = "off"
+	reg := testRegistration(t, s)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		fileType string
+		stored   string // mime_type column; "" leaves it NULL like a legacy row
+		data     []byte
+		want     string
+	}{
+		{"stored type wins", "passport", "application/pdf", sampleBlob, "application/pdf"},
+		{"legacy pdf is sniffed", "passport", "", samplePDF, "application/pdf"},
+		{"legacy png is sniffed", "photo", "", samplePNG, "image/png"},
+		{"legacy unknown passport", "passport", "", sampleBlob, "application/pdf"},
+		{"stored octet-stream is re-resolved", "photo", "application/octet-stream", sampleBlob, "image/jpeg"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileID, err := s.saveRegistrationFile(ctx, reg.RegistrationID, tt.fileType, "sample", tt.stored, tt.data, nil)
+			if err != nil {
+				t.Fatalf("save: %v", err)
+			}
+			if tt.stored == "" {
+				if _, err := s.db.Exec(ctx, `UPDATE file_upload SET mime_type = NULL WHERE file_id = $1`, fileID); err != nil {
+					t.Fatalf("clear mime_type: %v", err)
+				}
+			}
+
+			rec := httptest.NewRecorder()
+			s.downloadRegistrationFileHandler(rec, httptest.NewRequest(http.MethodGet, "/registration-files/"+fileID.String(), nil), fileID, uuid.Nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadsCountedPerDay(t *testing.T) {
+	s := testServer(t)
+	s.cfg.DownloadAuth = "off"
+	s.cfg.APIKey = "test-key"
+	reg := testRegistration(t, s)
+
+	fileID, err := s.saveRegistrationFile(context.Background(), reg.RegistrationID, "passport", "scan.pdf", "application/pdf", samplePDF, nil)
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	routes := s.v1Routes()
+	for range 2 {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/registration-files/"+fileID.String(), nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("download status = %d, want 200", rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/registration-files/"+fileID.String()+"/downloads?days=7", nil)
+	req.Header.Set("X-API-Key", s.cfg.APIKey)
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("downloads status = %d, want 200", rec.Code)
+	}
+	var got fileDownloads
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	today := time.Now().UTC().Format(time.DateOnly)
+	if got.DownloadCount != 2 || len(got.ByDay) != 1 || got.ByDay[0] != (fileDownloadDay{Day: today, Downloads: 2}) {
+		t.Errorf("downloads = %+v, want 2 in total, all on %s", got, today)
+	}
+}
+
+func TestFileDownloadsRejectsBadDays(t *testing.T) {
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	s.cfg.APIKey = "test-key"
+	routes := s.v1Routes()
+
+	for _, days := range []string{"0", "367", "week"} {
+		req := httptest.NewRequest(http.MethodGet, "/registration-files/"+uuid.NewString()+"/downloads?days="+days, nil)
+		req.Header.Set("X-API-Key", s.cfg.APIKey)
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"invalid_days"`) {
+			t.Errorf("days=%s: status %d body %s, want 400 invalid_days", days, rec.Code, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/registration-files/"+uuid.NewString()+"/downloads", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without the API key = %d, want 401", rec.Code)
+	}
+}
+
+func TestRegistrationCursorRoundTrip(t *testing.T) {
+	id := uuid.MustParse("6f1c2b3a-0d4e-4f5a-8b6c-7d8e9f0a1b2c")
+	for _, want := range []registrationCursor{
+		{Sort: "created_at", Desc: true, Value: "2024-05-01T03:04:05.123456Z", RegistrationID: id},
+		{Sort: "full_name", Value: "Budi", RegistrationID: id},
+		{Sort: "applicant_count", Desc: true, Value: "3", RegistrationID: id},
+	} {
+		got, err := decodeRegistrationCursor(encodeRegistrationCursor(want))
+		if err != nil {
+			t.Fatalf("decode %+v: %v", want, err)
+		}
+		if got != want {
+			t.Errorf("round trip = %+v, want %+v", got, want)
+		}
+	}
+
+	// cursors issued before ?sort= existed meant created_at descending
+	legacy := base64.RawURLEncoding.EncodeToString([]byte("2024-05-01T03:04:05Z|" + id.String()))
+	got, err := decodeRegistrationCursor(legacy)
+	if err != nil {
+		t.Fatalf("decode legacy: %v", err)
+	}
+	if want := (registrationCursor{Sort: "created_at", Desc: true, Value: "2024-05-01T03:04:05Z", RegistrationID: id}); got != want {
+		t.Errorf("legacy cursor = %+v, want %+v", got, want)
+	}
+
+	for _, bad := range []registrationCursor{
+		{Sort: "whatsapp_number", Value: "x", RegistrationID: id},
+		{Sort: "created_at", Value: "yesterday", RegistrationID: id},
+		{Sort: "applicant_count", Value: "many", RegistrationID: id},
+		{Sort: "full_name", Value: "Budi"},
+	} {
+		if _, err := decodeRegistrationCursor(encodeRegistrationCursor(bad)); err == nil {
+			t.Errorf("decodeRegistrationCursor accepted %+v", bad)
+		}
+	}
+	for _, bad := range []string{"", "not base64!", base64.RawURLEncoding.EncodeToString([]byte("yesterday|" + id.String()))} {
+		if _, err := decodeRegistrationCursor(bad); err == nil {
+			t.Errorf("decodeRegistrationCursor(%q) accepted a malformed cursor", bad)
+		}
+	}
+}
+
+func TestFallbackFilename(t *testing.T) {
+	id := uuid.MustParse("6f1c2b3a-0d4e-4f5a-8b6c-7d8e9f0a1b2c")
+	tests := []struct {
+		fileType, mimeType, want string
+	}{
+		{"photo", "image/jpeg", "photo-" + id.String() + ".jpg"},
+		{"Passport", "application/pdf", "passport-" + id.String() + ".pdf"},
+		{"photo", "image/png; charset=binary", "photo-" + id.String() + ".png"},
+		{"other", "application/x-unknown-thing", "other-" + id.String() + ".bin"},
+	}
+	for _, tt := range tests {
+		if got := fallbackFilename(tt.fileType, id, tt.mimeType); got != tt.want {
+			t.Errorf("fallbackFilename(%q, %q) = %q, want %q", tt.fileType, tt.mimeType, got, tt.want)
+		}
+	}
+}
+
+func TestUploadWithoutFilenameGetsFallback(t *testing.T) {
+	s := testServer(t)
+	s.cfg.DownloadAuth = "off"
+	reg := testRegistration(t, s)
+
+	// multipart drops an empty filename entirely, so blank clients send spaces
+	rec := httptest.NewRecorder()
+	req := newUploadRequest(t, "/registrations/"+reg.RegistrationID.String()+"/files", map[string]string{"file_type": "passport"}, " ", samplePDF)
+	s.uploadRegistrationFileHandler(rec, req, reg.RegistrationID)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("upload status = %d, want 201: %s", rec.Code, rec.Body.String())
+	}
+	var uploaded struct {
+		FileID uuid.UUID `json:"file_id"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&uploaded); err != nil {
+		t.Fatalf("decode upload: %v", err)
+	}
+
+	want := "passport-" + uploaded.FileID.String() + ".pdf"
+	rf, err := s.getRegistrationFile(context.Background(), uploaded.FileID)
+	if err != nil {
+		t.Fatalf("get file: %v", err)
+	}
+	if rf.Filename != want {
+		t.Errorf("stored filename = %q, want %q", rf.Filename, want)
+	}
+
+	rec = httptest.NewRecorder()
+	s.downloadRegistrationFileHandler(rec, httptest.NewRequest(http.MethodGet, "/registration-files/"+uploaded.FileID.String(), nil), uploaded.FileID, uuid.Nil)
+	if got, wantCD := rec.Header().Get("Content-Disposition"), `attachment; filename="`+want+`"`; got != wantCD {
+		t.Errorf("Content-Disposition = %q, want %q", got, wantCD)
+	}
+}
+
+func TestSimilarFormField(t *testing.T) {
+	tests := []struct {
+		want, submitted, similar string
+	}{
+		{"file", "File", "File"},
+		{"file_type", "fileType", "fileType"},
+		{"registration_id", "registration-id", "registration-id"},
+		{"file", "fle", "fle"},
+		{"file", "files", "files"},
+		{"file", "cv", ""},
+		{"file", "fold", ""},
+		{"file_type", "type", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/registration-files", nil)
+		r.MultipartForm = &multipart.Form{Value: map[string][]string{tt.submitted: {"x"}}}
+		if got := similarFormField(r, tt.want); got != tt.similar {
+			t.Errorf("similarFormField(%q) with %q submitted = %q, want %q", tt.want, tt.submitted, got, tt.similar)
+		}
+	}
+}
+
+func TestWriteServerErrorConstraintViolations(t *testing.T) {
+	tests := []struct {
+		err    *pgconn.PgError
+		status int
+		code   string
+		field  string
+	}{
+		{&pgconn.PgError{Code: pgUniqueViolation, Detail: "Key (whatsapp_number)=(+628123) already exists."}, http.StatusConflict, "conflict", "whatsapp_number"},
+		{&pgconn.PgError{Code: pgForeignKeyViolation, Detail: `Key (registration_id)=(00000000-0000-0000-0000-000000000000) is not present in table "registration".`}, http.StatusUnprocessableEntity, "invalid_reference", "registration_id"},
+		{&pgconn.PgError{Code: pgNotNullViolation, ColumnName: "full_name"}, http.StatusBadRequest, "constraint_violation", "full_name"},
+		{&pgconn.PgError{Code: pgCheckViolation, ConstraintName: "registration_applicant_count_check"}, http.StatusBadRequest, "constraint_violation", "registration_applicant_count_check"},
+		{&pgconn.PgError{Code: pgDeadlockDetected}, http.StatusInternalServerError, "internal_error", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Code, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeServerError(rec, httptest.NewRequest(http.MethodPost, "/registrations", nil), "test", fmt.Errorf("insert: %w", tt.err))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			var body map[string]string
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode body: %v", err)
+			}
+			if body["error"] != tt.code || body["field"] != tt.field {
+				t.Errorf("body = %v, want error %q field %q", body, tt.code, tt.field)
+			}
+			if strings.Contains(rec.Body.String(), "+628123") {
+				t.Errorf("body leaks the conflicting value: %s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestCountPDFPages(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want int // 0 means unknown
+	}{
+		{"two pages", []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n2 0 obj << /Type /Page >> endobj\n%%EOF\n"), 2},
+		{"pages tree is not a page", []byte("%PDF-1.4\n1 0 obj << /Type /Pages >> endobj\n2 0 obj << /Type /Page >> endobj\n%%EOF\n"), 1},
+		{"no trailer", []byte("%PDF-1.4\n1 0 obj << /Type /Page >> endobj\n"), 0},
+		{"no header", []byte("1 0 obj << /Type /Page >> endobj\n%%EOF\n"), 0},
+		{"no page objects", samplePDF, 0},
+		{"not a pdf", sampleBlob, 0},
+	}
+	for _, tt := range tests {
+		got := countPDFPages(tt.data)
+		switch {
+		case tt.want == 0 && got != nil:
+			t.Errorf("%s: page count %d, want unknown", tt.name, *got)
+		case tt.want != 0 && (got == nil || *got != tt.want):
+			t.Errorf("%s: page count %v, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// A part declared as application/pdf is accepted even when it doesn't sniff
+// as one; the malformed body leaves the page count unknown.
+func TestCVUploadTrustsDeclaredPDF(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	name := "Declared PDF"
+	user, err := s.insertUser(ctx, createUserRequest{Name: &name})
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+
+	upload := func(contentType string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="cv.pdf"`)
+		h.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatalf("create part: %v", err)
+		}
+		_, _ = part.Write([]byte("\r\n%PDF-1.4 garbled export"))
+		_ = mw.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/users/"+strconv.FormatInt(user.ID, 10)+"/cv", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rec := httptest.NewRecorder()
+		s.uploadUserCVHandler(rec, req, user.ID)
+		return rec.Code
+	}
+
+	if code := upload("application/octet-stream"); code != http.StatusBadRequest {
+		t.Errorf("undeclared upload status = %d, want 400", code)
+	}
+	if code := upload("application/pdf"); code != http.StatusCreated {
+		t.Fatalf("declared upload status = %d, want 201", code)
+	}
+
+	var (
+		mimeType  string
+		pageCount *int
+	)
+	if err := s.db.QueryRow(ctx, `SELECT mime_type, page_count FROM user_cvs WHERE user_id = $1 AND is_primary`, user.ID).Scan(&mimeType, &pageCount); err != nil {
+		t.Fatalf("read cv: %v", err)
+	}
+	if mimeType != "application/pdf" || pageCount != nil {
+		t.Errorf("stored mime %q, page count %v; want application/pdf and unknown", mimeType, pageCount)
+	}
+}
+
+func TestDownloadUserCVUsesStoredFilename(t *testing.T) {
+	s := testServer(t)
+	s.cfg.DownloadAuth = "off"
+	ctx := context.Background()
+
+	name := "Named CV"
+	user, err := s.insertUser(ctx, createUserRequest{Name: &name})
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	if _, _, err := s.saveUserCV(ctx, user.ID, samplePDF, "Resume 2024.pdf", "application/pdf", nil, false); err != nil {
+		t.Fatalf("save cv: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.downloadUserCVHandler(rec, httptest.NewRequest(http.MethodGet, "/users/"+strconv.FormatInt(user.ID, 10)+"/cv", nil), user.ID)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.Contains(got, "Resume 2024.pdf") {
+		t.Errorf("Content-Disposition = %q, want the stored filename", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("Content-Type = %q, want application/pdf", got)
+	}
+}
+
+func TestInlineCVEnvelopeCarriesCVID(t *testing.T) {
+	s := testServer(t)
+	s.cfg.DownloadAuth = "off"
+	ctx := context.Background()
+
+	name := "Inline CV"
+	user, err := s.insertUser(ctx, createUserRequest{Name: &name})
+	if err != nil {
+		t.Fatalf("insert user: %v", err)
+	}
+	cvID, _, err := s.saveUserCV(ctx, user.ID, samplePDF, "cv.pdf", "application/pdf", nil, false)
+	if err != nil {
+		t.Fatalf("save cv: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/users/"+strconv.FormatInt(user.ID, 10)+"/cv", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	s.downloadUserCVHandler(rec, req, user.ID)
+
+	var envelope struct {
+		FileID string `json:"file_id"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&envelope); err != nil {
+		t.Fatalf("decode envelope: %v", err)
+	}
+	if envelope.FileID != cvID.String() {
+		t.Errorf("file_id = %q, want cv_id %s", envelope.FileID, cvID)
+	}
+}
+
+func TestCVDownloadFollowsDownloadAuth(t *testing.T) {
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	s.cfg.DownloadAuth = "signed"
+	s.cfg.DownloadSigningKey = "test-signing-key"
+
+	rec := httptest.NewRecorder()
+	s.v1Routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/5/cv", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned CV download status = %d, want 401", rec.Code)
+	}
+
+	expires := time.Now().Add(time.Minute).Unix()
+	signed := func(resource string) *http.Request {
+		q := url.Values{}
+		q.Set("expires", strconv.FormatInt(expires, 10))
+		q.Set("signature", s.downloadSignature(resource, expires))
+		return httptest.NewRequest(http.MethodGet, "/users/5/cv?cv_id="+uuid.NewString()+"&"+q.Encode(), nil)
+	}
+	if !s.authorizeDownload(httptest.NewRecorder(), signed(cvDownloadResource(5)), cvDownloadResource(5)) {
+		t.Errorf("a URL signed for user 5 was refused")
+	}
+	if s.authorizeDownload(httptest.NewRecorder(), signed(cvDownloadResource(6)), cvDownloadResource(5)) {
+		t.Errorf("a URL signed for user 6 opened user 5's CV")
+	}
+}
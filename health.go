@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Component and overall statuses reported by /health/detail. A dependency
+// the service can run without makes it degraded; losing the primary makes
+// it down.
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthDown     = "down"
+)
+
+type healthComponent struct {
+	Status    string         `json:"status"`
+	LatencyMS *float64       `json:"latency_ms,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+// pingComponent pings pool and reports how long it took.
+func pingComponent(ctx context.Context, pool *pgxpool.Pool) healthComponent {
+	start := time.Now()
+	err := pool.Ping(ctx)
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		return healthComponent{Status: healthDown, LatencyMS: &ms, Error: err.Error()}
+	}
+	return healthComponent{Status: healthOK, LatencyMS: &ms}
+}
+
+// healthDetailHandler serves /health/detail: the state of every dependency
+// with its own status, rolled up into one. It exposes internals, so it needs
+// the API key. The response is 503 only when the service is down.
+func (s *server) healthDetailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("healthDetail start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET")
+		return
+	}
+	if !s.requireAPIKey(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer cancel()
+
+	components := map[string]healthComponent{}
+
+	db := pingComponent(ctx, s.db)
+	components["database"] = db
+
+	st := s.db.Stat()
+	pool := healthComponent{Status: healthOK, Details: map[string]any{
+		"acquired":          st.AcquiredConns(),
+		"idle":              st.IdleConns(),
+		"total":             st.TotalConns(),
+		"max":               st.MaxConns(),
+		"empty_acquires":    st.EmptyAcquireCount(),
+		"canceled_acquires": st.CanceledAcquireCount(),
+	}}
+	if st.MaxConns() > 0 && float64(st.AcquiredConns())/float64(st.MaxConns()) >= s.cfg.PoolWarnUtilization {
+		pool.Status = healthDegraded
+	}
+	components["pool"] = pool
+
+	migrationsHealth := healthComponent{Status: healthOK}
+	if applied, err := appliedSchemaVersion(ctx, s.db); err != nil {
+		migrationsHealth = healthComponent{Status: healthDown, Error: err.Error()}
+	} else {
+		migrationsHealth.Details = map[string]any{"applied": applied, "expected": len(migrations)}
+		if applied < len(migrations) {
+			migrationsHealth.Status = healthDegraded
+		}
+	}
+	components["migrations"] = migrationsHealth
+
+	// files and CVs are stored in the primary database, so storage is
+	// reachable exactly when the database is
+	components["storage"] = healthComponent{Status: db.Status, Details: map[string]any{"backend": "postgres"}}
+
+	if s.replica != nil {
+		replica := pingComponent(ctx, s.replica)
+		if replica.Status == healthDown {
+			replica.Status = healthDegraded
+		}
+		replica.Details = map[string]any{"serving_reads": s.replicaHealthy.Load()}
+		components["replica"] = replica
+	}
+
+	breaker := healthComponent{Status: healthOK, Details: map[string]any{"state": s.breaker.stateName()}}
+	if s.breaker.stateName() == "open" {
+		breaker.Status = healthDegraded
+	}
+	components["circuit_breaker"] = breaker
+
+	if s.cfg.ClamAVAddr != "" {
+		start := time.Now()
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", s.cfg.ClamAVAddr)
+		ms := float64(time.Since(start).Microseconds()) / 1000
+		clamav := healthComponent{Status: healthOK, LatencyMS: &ms}
+		if err != nil {
+			clamav.Status = healthDegraded
+			clamav.Error = err.Error()
+		} else {
+			_ = conn.Close()
+		}
+		components["clamav"] = clamav
+	}
+
+	overall := healthOK
+	for _, c := range components {
+		if c.Status == healthDegraded && overall == healthOK {
+			overall = healthDegraded
+		}
+	}
+	if db.Status == healthDown {
+		overall = healthDown
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":     overall,
+		"components": components,
+		"build": map[string]string{
+			"version":    version,
+			"commit":     commit,
+			"build_time": buildTime,
+		},
+		"checked_at": time.Now().UTC(),
+	})
+}
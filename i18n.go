@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Error responses carry a machine "error" code; localizeErrors adds a human
+// "message" for it in the caller's Accept-Language (Indonesian or English),
+// and for validation failures a "messages" object keyed like "fields". Codes
+// without a catalog entry get no message.
+
+//go:embed messages/*.json
+var messageFiles embed.FS
+
+const defaultLocale = "en"
+
+// messageCatalog maps locale -> error code -> message.
+var messageCatalog = loadMessageCatalog()
+
+func loadMessageCatalog() map[string]map[string]string {
+	catalog := map[string]map[string]string{}
+	for _, locale := range []string{"en", "id"} {
+		data, err := messageFiles.ReadFile("messages/" + locale + ".json")
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic("messages/" + locale + ".json: " + err.Error())
+		}
+		catalog[locale] = messages
+	}
+	return catalog
+}
+
+// requestLocale picks the supported locale the client ranks highest in
+// Accept-Language, falling back to English.
+func requestLocale(r *http.Request) string {
+	type candidate struct {
+		locale string
+		q      float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if _, ok := messageCatalog[base]; !ok {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{base, q})
+		}
+	}
+	if len(candidates) == 0 {
+		return defaultLocale
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+	return candidates[0].locale
+}
+
+func localizeErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		lw := &localeWriter{ResponseWriter: w, messages: messageCatalog[requestLocale(r)]}
+		next.ServeHTTP(lw, r)
+		lw.finish()
+	})
+}
+
+// localeWriter buffers JSON error responses (status >= 400) so a message can
+// be added; everything else streams straight through.
+type localeWriter struct {
+	http.ResponseWriter
+	messages  map[string]string
+	buf       bytes.Buffer
+	status    int
+	decided   bool
+	transform bool
+}
+
+func (lw *localeWriter) WriteHeader(code int) {
+	if lw.decided {
+		return
+	}
+	lw.decided = true
+	lw.status = code
+	lw.transform = code >= 400 && isJSONContentType(lw.Header().Get("Content-Type"))
+	if !lw.transform {
+		lw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (lw *localeWriter) Write(p []byte) (int, error) {
+	if !lw.decided {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.transform {
+		return lw.buf.Write(p)
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (lw *localeWriter) Unwrap() http.ResponseWriter { return lw.ResponseWriter }
+
+func (lw *localeWriter) finish() {
+	if !lw.transform {
+		return
+	}
+	out := lw.buf.Bytes()
+	if localized, ok := lw.localize(out); ok {
+		out = localized
+	}
+	lw.Header().Del("Content-Length")
+	lw.ResponseWriter.WriteHeader(lw.status)
+	if _, err := lw.ResponseWriter.Write(out); err != nil {
+		log.Printf("localizeErrors write failed: %v", err)
+	}
+}
+
+func (lw *localeWriter) localize(body []byte) ([]byte, bool) {
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, false
+	}
+
+	var code string
+	if err := json.Unmarshal(envelope["error"], &code); err != nil {
+		return nil, false
+	}
+	if _, ok := envelope["message"]; !ok {
+		if msg, ok := lw.messages[code]; ok {
+			envelope["message"], _ = json.Marshal(msg)
+		}
+	}
+
+	// validation failures map field -> code
+	var fields map[string]string
+	if err := json.Unmarshal(envelope["fields"], &fields); err == nil && len(fields) > 0 {
+		messages := make(map[string]string, len(fields))
+		for field, fieldCode := range fields {
+			if msg, ok := lw.messages[fieldCode]; ok {
+				messages[field] = msg
+			}
+		}
+		if len(messages) > 0 {
+			envelope["messages"], _ = json.Marshal(messages)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(envelope); err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
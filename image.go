@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// imageSize is the pixel size of an uploaded image.
+type imageSize struct {
+	Width  int
+	Height int
+}
+
+// measureImage reads the dimensions from an image header without decoding the
+// pixels. It returns nil for non-images and formats the stdlib can't parse.
+func measureImage(mimeType string, data []byte) *imageSize {
+	if !strings.HasPrefix(mimeType, "image/") {
+		return nil
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		log.Printf("measureImage: cannot read %s header: %v", mimeType, err)
+		return nil
+	}
+	return &imageSize{Width: cfg.Width, Height: cfg.Height}
+}
+
+// checkImageUpload measures image uploads and, for photos, enforces the
+// PHOTO_MIN_*/PHOTO_MAX_* bounds. Rejections are returned as *uploadError.
+func (s *server) checkImageUpload(fileType, mimeType string, data []byte) (*imageSize, error) {
+	size := measureImage(mimeType, data)
+	if size == nil || !strings.EqualFold(fileType, "photo") {
+		return size, nil
+	}
+
+	c := s.cfg
+	if size.Width < c.PhotoMinWidth || size.Height < c.PhotoMinHeight ||
+		(c.PhotoMaxWidth > 0 && size.Width > c.PhotoMaxWidth) ||
+		(c.PhotoMaxHeight > 0 && size.Height > c.PhotoMaxHeight) {
+		details := map[string]any{
+			"width":      size.Width,
+			"height":     size.Height,
+			"min_width":  c.PhotoMinWidth,
+			"min_height": c.PhotoMinHeight,
+		}
+		if c.PhotoMaxWidth > 0 {
+			details["max_width"] = c.PhotoMaxWidth
+		}
+		if c.PhotoMaxHeight > 0 {
+			details["max_height"] = c.PhotoMaxHeight
+		}
+		return nil, &uploadError{status: http.StatusBadRequest, code: "invalid_image_dimensions", details: details}
+	}
+	return size, nil
+}
+
+// columns returns the width/height column values, NULL for non-images.
+func (sz *imageSize) columns() (width, height *int) {
+	if sz == nil {
+		return nil, nil
+	}
+	return &sz.Width, &sz.Height
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// inlineFile is the JSON form of a download for clients that can't take a
+// binary response.
+type inlineFile struct {
+	FileID     string `json:"file_id"`
+	Filename   string `json:"filename"`
+	MimeType   string `json:"mime_type"`
+	Size       int    `json:"size"`
+	DataBase64 string `json:"data_base64"`
+}
+
+// prefersInlineJSON reports whether the client's Accept header ranks
+// application/json strictly above the file's own type. Wildcards count for
+// the file, so "*/*" and "application/json, */*" keep getting bytes; only a
+// client asking for JSON alone (or preferring it by q) gets the envelope.
+func prefersInlineJSON(r *http.Request, fileType string) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return false
+	}
+
+	fileMajor, _, _ := strings.Cut(fileType, "/")
+	jsonQ, fileQ := 0.0, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case fileType, fileMajor + "/*", "*/*":
+			fileQ = max(fileQ, q)
+		}
+	}
+	return jsonQ > fileQ
+}
+
+// writeInlineFile answers with the file base64-encoded in JSON, or 413 when
+// it is over INLINE_FILE_MAX_BYTES. It reports whether the file was written.
+func (s *server) writeInlineFile(w http.ResponseWriter, logPrefix string, f inlineFile, data []byte) bool {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Add("Vary", "Accept")
+
+	if int64(len(data)) > s.cfg.InlineFileMaxBytes {
+		log.Printf("%s inline file too large: %d bytes, limit %d", logPrefix, len(data), s.cfg.InlineFileMaxBytes)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "file_too_large_for_inline", "limit_bytes": s.cfg.InlineFileMaxBytes})
+		return false
+	}
+
+	f.Size = len(data)
+	f.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	if err := json.NewEncoder(w).Encode(f); err != nil {
+		log.Printf("%s inline encode failed: %v", logPrefix, err)
+		return false
+	}
+	return true
+}
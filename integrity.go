@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// contentHash is the hex SHA-256 of the original (uncompressed) bytes, as
+// stored in content_hash and the CV hash columns.
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkDownloadIntegrity advertises the stored hash in X-Content-SHA256 and,
+// with ?verify=true, re-hashes the bytes first. On a mismatch it answers 500
+// integrity_check_failed and returns false. Rows stored before hashing
+// existed have no hash and are served unchecked.
+func checkDownloadIntegrity(w http.ResponseWriter, r *http.Request, logPrefix string, data []byte, storedHash *string) bool {
+	if storedHash == nil || *storedHash == "" {
+		return true
+	}
+
+	if verify, _ := strconv.ParseBool(r.URL.Query().Get("verify")); verify {
+		if actual := contentHash(data); actual != *storedHash {
+			log.Printf("%s integrity check failed: stored=%s actual=%s", logPrefix, *storedHash, actual)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"error":  "integrity_check_failed",
+				"detail": "stored bytes do not match their recorded SHA-256",
+			})
+			return false
+		}
+	}
+
+	w.Header().Set("X-Content-SHA256", *storedHash)
+	return true
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// The API's wire format is snake_case, as declared in the struct tags. Clients
+// that prefer camelCase ask for it with "Accept: application/json; case=camel"
+// or "X-JSON-Case: camel"; jsonCase then re-keys JSON responses to camelCase
+// and JSON request bodies back to snake_case, so handlers only ever see the
+// tagged names.
+
+func wantsCamelCase(r *http.Request) bool {
+	if strings.EqualFold(strings.TrimSpace(r.Header.Get("X-JSON-Case")), "camel") {
+		return true
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || (mediaType != "application/json" && mediaType != "*/*") {
+			continue
+		}
+		if strings.EqualFold(params["case"], "camel") {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonCase has to read a camelCase request body whole to re-key it, so the
+// body is capped at MAX_CAMEL_CASE_BODY_BYTES.
+func (s *server) jsonCase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept, X-JSON-Case")
+		if !wantsCamelCase(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// gunzipRequest re-keys compressed bodies once it has inflated them
+		if isJSONContentType(r.Header.Get("Content-Type")) && r.Body != nil && !gzipEncoded(r) {
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.cfg.MaxCamelCaseBody))
+			if err != nil {
+				log.Printf("jsonCase read body failed: %v", err)
+				w.Header().Set("Content-Type", "application/json")
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					w.WriteHeader(http.StatusRequestEntityTooLarge)
+					_ = json.NewEncoder(w).Encode(map[string]any{"error": "body_too_large", "max_bytes": maxErr.Limit})
+					return
+				}
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_json"})
+				return
+			}
+			body = snakeCaseBody(body)
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		cw := &caseWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		cw.finish()
+	})
+}
+
+// snakeCaseBody re-keys a camelCase JSON request body to the tagged
+// snake_case names; a body that isn't valid JSON is returned unchanged for
+// the handler's decoder to reject.
+func snakeCaseBody(body []byte) []byte {
+	if rekeyed, ok := rekeyJSON(body, camelToSnake); ok {
+		return rekeyed
+	}
+	return body
+}
+
+// caseWriter buffers JSON responses so they can be re-keyed; anything else
+// (file downloads, exports) streams straight through.
+type caseWriter struct {
+	http.ResponseWriter
+	buf       bytes.Buffer
+	status    int
+	decided   bool
+	transform bool
+}
+
+func (cw *caseWriter) WriteHeader(code int) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+	cw.status = code
+	cw.transform = isJSONContentType(cw.Header().Get("Content-Type"))
+	if !cw.transform {
+		cw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (cw *caseWriter) Write(p []byte) (int, error) {
+	if !cw.decided {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.transform {
+		return cw.buf.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *caseWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+func (cw *caseWriter) finish() {
+	if !cw.transform {
+		return
+	}
+	out, ok := rekeyJSON(cw.buf.Bytes(), snakeToCamel)
+	if !ok {
+		out = cw.buf.Bytes()
+	}
+	cw.Header().Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if _, err := cw.ResponseWriter.Write(out); err != nil {
+		log.Printf("jsonCase write failed: %v", err)
+	}
+}
+
+func isJSONContentType(ct string) bool {
+	mediaType, _, err := mime.ParseMediaType(ct)
+	return err == nil && mediaType == "application/json"
+}
+
+// rekeyJSON renames every object key in a JSON document with rename. Numbers
+// are kept verbatim. ok is false when data isn't valid JSON.
+func rekeyJSON(data []byte, rename func(string) string) ([]byte, bool) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return data, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(rekey(v, rename)); err != nil {
+		return data, false
+	}
+	return buf.Bytes(), true
+}
+
+func rekey(v any, rename func(string) string) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, val := range t {
+			out[rename(k)] = rekey(val, rename)
+		}
+		return out
+	case []any:
+		for i := range t {
+			t[i] = rekey(t[i], rename)
+		}
+		return t
+	default:
+		return v
+	}
+}
+
+// snakeToCamel turns "full_name" into "fullName".
+func snakeToCamel(s string) string {
+	if !strings.Contains(s, "_") {
+		return s
+	}
+	var b strings.Builder
+	upper := false
+	for _, r := range s {
+		if r == '_' {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// camelToSnake turns "fullName" into "full_name".
+func camelToSnake(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
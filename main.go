@@ -2,10 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // prod param
@@ -17,32 +24,211 @@ const serviceHost = "https://safaraya-service.onrender.com"
 // const serviceHost = "http://localhost:8080"
 const cvDownloadPathTemplate = "/users/%d/cv"
 
+// build info, set at build time:
+// go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse --short HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
 func main() {
 	ctx := context.Background()
+	cfg := loadConfig()
+	if cfg.ReadOnly {
+		log.Println("READ_ONLY enabled: mutating endpoints will return 503")
+	}
+	if cfg.APIKey == "" {
+		log.Println("API_KEY not set: admin endpoints are disabled")
+	}
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		log.Printf("CORS enabled for origins: %s", strings.Join(cfg.CORSAllowedOrigins, ", "))
+	}
+	if cfg.ClamAVAddr != "" {
+		log.Printf("upload scanning enabled: clamd=%s fail_open=%t", cfg.ClamAVAddr, cfg.ClamAVFailOpen)
+	}
 
+	log.Printf("starting safaraya-service version=%s commit=%s built=%s", version, commit, buildTime)
 	log.Println("connecting to database..")
-	pool, err := pgxpool.New(ctx, dbURL)
+	poolCfg, err := pgxpool.ParseConfig(dbURL)
+	if err != nil {
+		log.Fatalf("failed to parse db url: %v", err)
+	}
+	breaker := newDBBreaker(cfg.DBBreakerFailures, cfg.DBBreakerCooldown)
+	if breaker != nil {
+		poolCfg.ConnConfig.Tracer = breaker
+		log.Printf("db circuit breaker enabled: opens after %d failures for %s", cfg.DBBreakerFailures, cfg.DBBreakerCooldown)
+	}
+	pool, err := pgxpool.NewWithConfig(ctx, poolCfg)
 	if err != nil {
 		log.Fatalf("failed to init db: %v", err)
 	}
 	log.Println("database connection pool established")
 	defer pool.Close()
 
-	srv := &server{db: pool}
+	if cfg.PoolStatsInterval > 0 {
+		go monitorPool(ctx, pool, cfg.PoolStatsInterval, cfg.PoolWarnUtilization)
+	}
+
+	if err := runMigrations(ctx, pool); err != nil {
+		log.Fatalf("failed to run migrations: %v", err)
+	}
+
+	srv := &server{
+		db:         pool,
+		cfg:        cfg,
+		regCache:   newRegistrationCache(cfg.RegistrationCacheSize, cfg.RegistrationCacheTTL),
+		usersStale: newUsersStaleCache(cfg.UsersStaleTTL),
+		breaker:    breaker,
+		webhook:    newWebhookNotifier(cfg.WebhookURL, cfg.WebhookTimeout, cfg.WebhookMaxAttempts, cfg.WebhookRetryBackoff),
+		flags:      newFeatureFlags(),
+	}
+	if flags, err := srv.loadFeatureFlags(ctx); err != nil {
+		log.Printf("failed to load feature flags, using defaults: %v", err)
+	} else {
+		srv.flags.replace(flags)
+	}
+	if cfg.FeatureFlagRefresh > 0 {
+		go srv.refreshFeatureFlags(ctx, cfg.FeatureFlagRefresh)
+	}
+	if cfg.MaxConcurrentUploads > 0 {
+		srv.uploadSlots = make(chan struct{}, cfg.MaxConcurrentUploads)
+	}
+	srv.limiter = newRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	if srv.limiter != nil {
+		log.Printf("rate limiting enabled: %g req/s per client, burst %d", cfg.RateLimitRPS, cfg.RateLimitBurst)
+	}
+	if srv.usersStale != nil {
+		log.Printf("users stale fallback enabled: ttl=%s", cfg.UsersStaleTTL)
+	}
+	if srv.regCache != nil {
+		log.Printf("registration cache enabled: size=%d ttl=%s", cfg.RegistrationCacheSize, cfg.RegistrationCacheTTL)
+	}
+
+	if srv.webhook != nil {
+		go srv.webhook.run(ctx)
+		log.Printf("registration webhook enabled: timeout=%s attempts=%d", cfg.WebhookTimeout, cfg.WebhookMaxAttempts)
+	}
+
+	if cfg.UploadSessionTTL > 0 {
+		go srv.expireUploadSessions(ctx, cfg.UploadSessionTTL, min(cfg.UploadSessionTTL, 10*time.Minute))
+	}
+
+	if cfg.ReplicaURL != "" {
+		replica, err := pgxpool.New(ctx, cfg.ReplicaURL)
+		if err != nil {
+			log.Fatalf("failed to init replica db: %v", err)
+		}
+		defer replica.Close()
+
+		srv.replica = replica
+		go srv.monitorReplica(ctx, 15*time.Second)
+		log.Println("read replica configured: read-only queries will use the replica while healthy")
+	} else {
+		log.Println("no read replica configured: all queries use the primary")
+	}
 
 	log.Println("registering handlers")
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ping", pingHandler)
-	mux.HandleFunc("/users", srv.usersHandler)
-	mux.HandleFunc("/users/", srv.userCVHandler)
-	mux.HandleFunc("/registrations", srv.registrationsHandler)
-	mux.HandleFunc("/registrations/", srv.registrationDetailHandler)
-	mux.HandleFunc("/registration-files", srv.registrationFilesHandler)
-	mux.HandleFunc("/registration-files/", srv.registrationFileHandler)
-	mux.HandleFunc("/", notFoundHandler)
+	mux.HandleFunc("/version", versionHandler)
+	mux.HandleFunc("/healthz", srv.healthzHandler)
+	mux.HandleFunc("/health/detail", srv.healthDetailHandler)
+	mux.Handle("/metrics", promhttp.Handler())
+	// exactly "/"; every other unmatched path still falls through to a 404
+	mux.HandleFunc("/{$}", srv.rootHandler)
+	if cfg.BasePath == "" {
+		mux.Handle("/", srv.rateLimit(srv.gunzipRequest(srv.circuitBreaker(srv.apiRoutes()))))
+	} else {
+		log.Printf("serving API under base path %s", cfg.BasePath)
+		api := srv.rateLimit(srv.gunzipRequest(srv.circuitBreaker(srv.apiRoutes())))
+		mux.Handle(cfg.BasePath+"/", http.StripPrefix(cfg.BasePath, api))
+		// the bare prefix is the API root; without this the mux would redirect
+		// it to the slash form, which trimTrailingSlash undoes, looping forever
+		mux.HandleFunc(cfg.BasePath, func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = "/"
+			api.ServeHTTP(w, r)
+		})
+		mux.HandleFunc("/", notFoundHandler)
+	}
+
+	httpServer := &http.Server{
+		Addr:    ":8080",
+		Handler: requestID(srv.cors(srv.gzipResponse(srv.jsonCase(localizeErrors(srv.requestDeadline(srv.readOnlyMiddleware(trimTrailingSlash(mux)))))))),
+	}
+
+	stopCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(cfg.FileRetention) > 0 {
+		go srv.sweepExpiredFiles(stopCtx, time.Hour)
+		log.Printf("file retention enabled for %d file types", len(cfg.FileRetention))
+	}
 
-	log.Println("HTTP server listening on :8080")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
-		log.Fatalf("server failed: %v", err)
+	if cfg.RegistrationArchiveAfter > 0 {
+		go srv.archiveRegistrations(stopCtx, cfg.RegistrationArchiveAfter, time.Hour)
+		log.Printf("registration archival enabled: final registrations older than %s", cfg.RegistrationArchiveAfter)
 	}
+
+	go func() {
+		log.Println("HTTP server listening on :8080")
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server failed: %v", err)
+		}
+	}()
+
+	var debugServer *http.Server
+	if cfg.PprofEnabled {
+		if cfg.APIKey == "" {
+			log.Println("PPROF_ENABLED set but API_KEY is empty: profiles will refuse every request")
+		}
+		debugServer = srv.pprofServer(cfg.PprofAddr)
+		go func() {
+			log.Printf("pprof listening on %s", cfg.PprofAddr)
+			if err := debugServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("pprof server failed: %v", err)
+			}
+		}()
+	}
+
+	<-stopCtx.Done()
+	log.Println("shutdown signal received")
+	if debugServer != nil {
+		_ = debugServer.Close()
+	}
+	srv.shutdown(httpServer, cfg.ShutdownDrainTimeout)
+	log.Println("shutdown complete, closing database pools")
+}
+
+// apiRoutes serves the versioned API relative to the service root; main
+// mounts it under BASE_PATH when one is configured. The unversioned paths are
+// deprecated aliases of v1 kept for existing clients.
+func (s *server) apiRoutes() *http.ServeMux {
+	v1 := withAPIVersion("v1", s.v1Routes())
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/", http.StripPrefix("/v1", v1))
+	mux.HandleFunc("/v1", func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = "/"
+		v1.ServeHTTP(w, r)
+	})
+	mux.Handle("/", s.deprecatedUnversioned(withAPIVersion("", s.v1Routes())))
+	return mux
+}
+
+func (s *server) v1Routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", s.usersHandler)
+	mux.HandleFunc("/users/", s.userCVHandler)
+	mux.HandleFunc("/registrations", s.registrationsHandler)
+	mux.HandleFunc("/registrations/", s.registrationDetailHandler)
+	mux.HandleFunc("/registration-files", s.registrationFilesHandler)
+	mux.HandleFunc("/registration-files/", s.registrationFileHandler)
+	mux.HandleFunc("/uploads", s.uploadsHandler)
+	mux.HandleFunc("/uploads/", s.uploadSessionHandler)
+	mux.HandleFunc("/admin/flags", s.adminFlagsHandler)
+	mux.HandleFunc("/admin/flags/", s.adminFlagHandler)
+	mux.HandleFunc("/debug/echo", s.debugEchoHandler)
+	mux.HandleFunc("/", notFoundHandler)
+	return mux
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var registrationCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "registration_cache_requests_total",
+	Help: "Lookups against the registration detail cache, by result (hit or miss).",
+}, []string{"result"})
+
+var dbReadRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "db_read_retries_total",
+	Help: "Retries of idempotent reads after a transient database error, by operation.",
+}, []string{"op"})
+
+var dbBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "db_circuit_breaker_state",
+	Help: "State of the database circuit breaker: 0 closed, 1 half-open, 2 open.",
+})
+
+var webhookDeliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "webhook_delivery_failures_total",
+	Help: "Webhook events dropped after exhausting delivery attempts, by event.",
+}, []string{"event"})
+
+// Upload sizes are labelled by endpoint and file_type; file_type is client
+// input, so observeUpload folds unconfigured types into "other".
+var uploadBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "upload_bytes",
+	Help:    "Size of accepted uploads in bytes, by endpoint and file_type.",
+	Buckets: prometheus.ExponentialBuckets(16<<10, 4, 7), // 16KiB .. 64MiB
+}, []string{"endpoint", "file_type"})
+
+var uploadBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "upload_bytes_total",
+	Help: "Bytes accepted through upload endpoints, by endpoint and file_type.",
+}, []string{"endpoint", "file_type"})
+
+var validationRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "validation_rejections_total",
+	Help: "Request fields rejected by validation, by field.",
+}, []string{"field"})
+
+// observeUpload records an accepted upload. The client's instruments are
+// safe for concurrent use, so handlers call it directly.
+func (s *server) observeUpload(endpoint, fileType string, size int) {
+	fileType = strings.ToLower(fileType)
+	if _, ok := s.cfg.FileTypeMimeTypes[fileType]; !ok && fileType != "cv" && !s.requiredFileType(fileType) {
+		fileType = "other"
+	}
+	uploadBytes.WithLabelValues(endpoint, fileType).Observe(float64(size))
+	uploadBytesTotal.WithLabelValues(endpoint, fileType).Add(float64(size))
+}
+
+func (s *server) requiredFileType(fileType string) bool {
+	for _, types := range s.cfg.RequiredFileTypes {
+		if slices.Contains(types, fileType) {
+			return true
+		}
+	}
+	return false
+}
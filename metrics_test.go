@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveUploadConcurrentTotals(t *testing.T) {
+	s := &server{cfg: loadConfig()}
+
+	const (
+		workers = 16
+		uploads = 200
+	)
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		sum int
+	)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sent := 0
+			for i := range uploads {
+				size := (w+1)*1000 + i
+				s.observeUpload("metricsTest", "photo", size)
+				sent += size
+			}
+			mu.Lock()
+			sum += sent
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if got := testutil.ToFloat64(uploadBytesTotal.WithLabelValues("metricsTest", "photo")); got != float64(sum) {
+		t.Errorf("upload_bytes_total = %v, want %d", got, sum)
+	}
+}
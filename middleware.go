@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// readOnlyMiddleware rejects every mutating request while the service runs in
+// maintenance mode, leaving reads and the POST routes that write nothing
+// untouched.
+func (s *server) readOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.cfg.ReadOnly || isSafeMethod(r.Method) || s.writesNothing(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log.Printf("read only mode: rejected method=%s path=%s remote=%s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "read_only_mode"})
+	})
+}
+
+// writesNothing reports the POST routes that only inspect their body. path is
+// the raw request path, before BASE_PATH and /v1 are stripped.
+func (s *server) writesNothing(path string) bool {
+	path = strings.TrimRight(path, "/")
+	if s.cfg.BasePath != "" {
+		var ok bool
+		if path, ok = strings.CutPrefix(path, s.cfg.BasePath); !ok {
+			return false
+		}
+	}
+	switch strings.TrimPrefix(path, "/v1") {
+	case "/registrations/validate", "/debug/echo":
+		return true
+	}
+	return false
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// trimTrailingSlash serves "/users/5/cv/" exactly like "/users/5/cv" so the
+// segment-count checks in the detail handlers and the mux's exact-match
+// patterns ("/users" vs "/users/") see one canonical path. Requests are
+// rewritten rather than redirected so POST bodies aren't lost.
+func trimTrailingSlash(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.URL.Path) > 1 && strings.HasSuffix(r.URL.Path, "/") {
+			r.URL.Path = strings.TrimRight(r.URL.Path, "/")
+			if r.URL.Path == "" {
+				r.URL.Path = "/"
+			}
+			r.URL.RawPath = ""
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestDeadline caps the total time a request may take. Handlers derive
+// their DB contexts from r.Context(), so every query in a request shares this
+// one budget.
+func (s *server) requestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.cfg.RequestTimeout
+		if d, ok := s.cfg.RequestTimeoutByMethod[r.Method]; ok {
+			timeout = d
+		}
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type apiVersionKey struct{}
+
+// supportedAPIVersions is reported by /version.
+var supportedAPIVersions = []string{"v1"}
+
+// withAPIVersion records which versioned surface served the request; "" means
+// the deprecated unversioned aliases.
+func withAPIVersion(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	})
+}
+
+func apiVersion(r *http.Request) string {
+	v, _ := r.Context().Value(apiVersionKey{}).(string)
+	return v
+}
+
+// deprecatedUnversioned marks responses from the unprefixed routes as
+// deprecated and points clients at the /v1 equivalent under BASE_PATH.
+func (s *server) deprecatedUnversioned(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("deprecated unversioned route: method=%s path=%s remote=%s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+s.cfg.BasePath+"/v1"+r.URL.Path+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireAPIKey gates admin operations on the X-API-Key header (or a Bearer
+// token). With no API_KEY configured every gated call is refused. It writes
+// the 401 itself and reports whether the caller may proceed.
+func (s *server) requireAPIKey(w http.ResponseWriter, r *http.Request) bool {
+	if s.hasAPIKey(r) {
+		return true
+	}
+
+	log.Printf("unauthorized: method=%s path=%s remote=%s", r.Method, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer realm="safaraya"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+	return false
+}
+
+// hasAPIKey reports whether the request carries the configured API key,
+// without answering the request when it doesn't.
+func (s *server) hasAPIKey(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return s.cfg.APIKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(s.cfg.APIKey)) == 1
+}
+
+// requireUploadOrigin rejects uploads from origins outside
+// UPLOAD_ALLOWED_ORIGINS with 403. The Referer stands in when a browser omits
+// Origin; with neither header the request passes unless the mode is strict.
+func (s *server) requireUploadOrigin(w http.ResponseWriter, r *http.Request) bool {
+	allowed := s.cfg.UploadAllowedOrigins
+	if len(allowed) == 0 {
+		return true
+	}
+
+	origin := requestOrigin(r)
+	if origin == "" && !s.cfg.UploadOriginStrict {
+		return true
+	}
+	if origin != "" && slices.Contains(allowed, origin) {
+		return true
+	}
+
+	log.Printf("upload rejected: origin=%q not allowed, path=%s remote=%s", origin, r.URL.Path, r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": "origin_not_allowed"})
+	return false
+}
+
+// requestOrigin returns the lowercased scheme://host the request came from,
+// taken from Origin or else from Referer, or "" when neither says.
+func requestOrigin(r *http.Request) string {
+	if origin := strings.TrimSpace(r.Header.Get("Origin")); origin != "" {
+		return strings.ToLower(origin)
+	}
+	ref, err := url.Parse(strings.TrimSpace(r.Header.Get("Referer")))
+	if err != nil || ref.Scheme == "" || ref.Host == "" {
+		return ""
+	}
+	return strings.ToLower(ref.Scheme + "://" + ref.Host)
+}
+
+// requestID tags every response with X-Request-ID, reusing a caller-supplied
+// id so traces can be joined across services.
+func requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimSpace(r.Header.Get("X-Request-ID"))
+		if id == "" || len(id) > 128 {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cors answers preflights and decorates responses for origins in
+// CORS_ALLOWED_ORIGINS ("*" allows any). Requests from other origins pass
+// through untouched, so the browser blocks them.
+func (s *server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.originAllowed(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Add("Vary", "Origin")
+		if len(s.cfg.CORSExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(s.cfg.CORSExposeHeaders, ", "))
+		}
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", reqHeaders)
+		}
+		if s.cfg.CORSMaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(s.cfg.CORSMaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *server) originAllowed(origin string) bool {
+	allowed := s.cfg.CORSAllowedOrigins
+	return slices.Contains(allowed, "*") || slices.Contains(allowed, strings.ToLower(origin))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrimTrailingSlash(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"//", "/"},
+		{"/users", "/users"},
+		{"/users/", "/users"},
+		{"/users/5/cv", "/users/5/cv"},
+		{"/users/5/cv/", "/users/5/cv"},
+		{"/users/5/cv//", "/users/5/cv"},
+		{"/registrations/", "/registrations"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var got string
+			h := trimTrailingSlash(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.URL.Path
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if got != tt.want {
+				t.Errorf("path = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Each route must answer the same with and without a trailing slash. The
+// requests stop before any database call.
+func TestRoutesIgnoreTrailingSlash(t *testing.T) {
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	h := trimTrailingSlash(s.v1Routes())
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodDelete, "/users", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/registrations", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/registration-files", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/users/abc/cv", http.StatusBadRequest},
+		{http.MethodGet, "/registrations/not-a-uuid", http.StatusBadRequest},
+		{http.MethodGet, "/registration-files/not-a-uuid", http.StatusBadRequest},
+		{http.MethodGet, "/nope", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		for _, path := range []string{tt.path, tt.path + "/"} {
+			t.Run(tt.method+" "+path, func(t *testing.T) {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest(tt.method, path, nil))
+				if rec.Code != tt.status {
+					t.Errorf("status = %d, want %d", rec.Code, tt.status)
+				}
+			})
+		}
+	}
+}
+
+func TestDeprecatedUnversionedLinkUsesBasePath(t *testing.T) {
+	for _, basePath := range []string{"", "/api"} {
+		s := &server{cfg: loadConfig()}
+		s.cfg.BasePath = basePath
+		h := s.deprecatedUnversioned(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users/5/cv", nil))
+		want := "<" + basePath + `/v1/users/5/cv>; rel="successor-version"`
+		if got := rec.Header().Get("Link"); got != want {
+			t.Errorf("base path %q: Link = %q, want %q", basePath, got, want)
+		}
+	}
+}
+
+func TestReadOnlyAllowsNonWritingPosts(t *testing.T) {
+	tests := []struct {
+		basePath, method, path string
+		allowed                bool
+	}{
+		{"", http.MethodGet, "/registrations", true},
+		{"", http.MethodPost, "/registrations", false},
+		{"", http.MethodPost, "/registrations/validate", true},
+		{"", http.MethodPost, "/v1/registrations/validate/", true},
+		{"", http.MethodPost, "/debug/echo", true},
+		{"/api", http.MethodPost, "/api/v1/registrations/validate", true},
+		{"/api", http.MethodPost, "/registrations/validate", false},
+		{"", http.MethodPost, "/registrations/validate/extra", false},
+	}
+	for _, tt := range tests {
+		s := &server{cfg: loadConfig()}
+		s.cfg.ReadOnly = true
+		s.cfg.BasePath = tt.basePath
+		reached := false
+		h := s.readOnlyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+		if reached != tt.allowed {
+			t.Errorf("%s %s%s: allowed = %t, want %t", tt.method, tt.basePath, tt.path, reached, tt.allowed)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrations are applied in order at startup. The slice index + 1 is the
+// schema version, so entries must only ever be appended.
+var migrations = []string{
+	// 1: stored MIME type for registration files
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS mime_type TEXT`,
+	// 2: track in-place replacement of registration files
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now()`,
+	// 3: page count extracted from uploaded CVs
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_page_count INT`,
+	// 4: per-file download counter
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS download_count BIGINT NOT NULL DEFAULT 0`,
+	// 5: gzip-compressed blob storage
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS compressed BOOLEAN NOT NULL DEFAULT false;
+	 ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_compressed BOOLEAN NOT NULL DEFAULT false`,
+	// 6: CV metadata so clients can inspect a CV without downloading it
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_filename TEXT;
+	 ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_mime_type TEXT;
+	 ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_size BIGINT;
+	 ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_updated_at TIMESTAMPTZ`,
+	// 7: previous CV versions, archived whenever a new CV replaces them
+	`CREATE TABLE IF NOT EXISTS cv_history (
+		version_id    UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id       BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		cv_file       BYTEA NOT NULL,
+		cv_compressed BOOLEAN NOT NULL DEFAULT false,
+		cv_filename   TEXT,
+		cv_mime_type  TEXT,
+		cv_size       BIGINT,
+		uploaded_at   TIMESTAMPTZ,
+		archived_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS cv_history_user_id_idx ON cv_history (user_id)`,
+	// 8: pixel dimensions of image uploads
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS width INT;
+	 ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS height INT`,
+	// 9: soft delete for registration files
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+	// 10: per-user CV size override above the global upload limit
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_max_bytes BIGINT`,
+	// 11: registration processing status
+	`ALTER TABLE registration ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'pending'`,
+	// 12: SHA-256 of stored blobs for download integrity checks
+	`ALTER TABLE file_upload ADD COLUMN IF NOT EXISTS content_hash TEXT;
+	 ALTER TABLE users ADD COLUMN IF NOT EXISTS cv_hash TEXT;
+	 ALTER TABLE cv_history ADD COLUMN IF NOT EXISTS cv_hash TEXT`,
+	// 13: resumable upload sessions, assembled chunk by chunk
+	`CREATE TABLE IF NOT EXISTS upload_session (
+		upload_id       UUID PRIMARY KEY,
+		target          TEXT NOT NULL,
+		registration_id UUID REFERENCES registration(registration_id) ON DELETE CASCADE,
+		user_id         BIGINT REFERENCES users(id) ON DELETE CASCADE,
+		file_type       TEXT,
+		filename        TEXT NOT NULL DEFAULT '',
+		upload_length   BIGINT NOT NULL,
+		upload_offset   BIGINT NOT NULL DEFAULT 0,
+		data            BYTEA NOT NULL DEFAULT ''::bytea,
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS upload_session_updated_at_idx ON upload_session (updated_at)`,
+	// 14: audit trail for compliance actions; no foreign keys so entries
+	// outlive the rows they describe
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		audit_id   UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		action     TEXT NOT NULL,
+		user_id    BIGINT,
+		details    JSONB NOT NULL DEFAULT '{}',
+		request_id TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id)`,
+	// 15: runtime feature flags; absent rows fall back to the defaults in code
+	`CREATE TABLE IF NOT EXISTS feature_flags (
+		name       TEXT PRIMARY KEY,
+		enabled    BOOLEAN NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	// 16: every registration status change, written with the change itself
+	`CREATE TABLE IF NOT EXISTS registration_status_history (
+		history_id      BIGSERIAL PRIMARY KEY,
+		registration_id UUID NOT NULL REFERENCES registration (registration_id) ON DELETE CASCADE,
+		from_status     TEXT NOT NULL,
+		to_status       TEXT NOT NULL,
+		changed_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		request_id      TEXT
+	);
+	CREATE INDEX IF NOT EXISTS registration_status_history_registration_idx
+		ON registration_status_history (registration_id, changed_at)`,
+	// 17: age-based archival; lists exclude archived rows unless asked
+	`ALTER TABLE registration ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS registration_active_created_at_idx
+		ON registration (created_at) WHERE archived_at IS NULL`,
+	// 18: several CVs per user, one of them primary. Existing CVs become the
+	// user's primary; the users.cv_* columns are left in place so the
+	// previous release can still be rolled back to.
+	`CREATE TABLE IF NOT EXISTS user_cvs (
+		cv_id       UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id     BIGINT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		data        BYTEA NOT NULL,
+		compressed  BOOLEAN NOT NULL DEFAULT false,
+		filename    TEXT,
+		mime_type   TEXT,
+		size        BIGINT,
+		hash        TEXT,
+		page_count  INT,
+		is_primary  BOOLEAN NOT NULL DEFAULT false,
+		uploaded_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS user_cvs_user_id_idx ON user_cvs (user_id);
+	CREATE UNIQUE INDEX IF NOT EXISTS user_cvs_primary_idx ON user_cvs (user_id) WHERE is_primary;
+	INSERT INTO user_cvs (user_id, data, compressed, filename, mime_type, size, hash, page_count, is_primary, uploaded_at)
+	SELECT id, cv_file, cv_compressed, cv_filename, cv_mime_type, cv_size, cv_hash, cv_page_count, true, COALESCE(cv_updated_at, created_at)
+	FROM users
+	WHERE cv_file IS NOT NULL`,
+	// 19: file_type is stored trimmed and lowercased; fix rows saved before
+	`UPDATE file_upload SET file_type = lower(btrim(file_type, E' \t\r\n'))
+	WHERE file_type <> lower(btrim(file_type, E' \t\r\n'));
+	UPDATE upload_session SET file_type = lower(btrim(file_type, E' \t\r\n'))
+	WHERE file_type <> lower(btrim(file_type, E' \t\r\n'))`,
+	// 20: a session is claimed by the one finalize request that stores it
+	`ALTER TABLE upload_session ADD COLUMN IF NOT EXISTS finalizing BOOLEAN NOT NULL DEFAULT false`,
+	// 21: downloads per file per UTC day, next to the running download_count
+	`CREATE TABLE IF NOT EXISTS file_download_daily (
+		file_id   UUID NOT NULL REFERENCES file_upload (file_id) ON DELETE CASCADE,
+		day       DATE NOT NULL,
+		downloads BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (file_id, day)
+	)`,
+}
+
+func runMigrations(ctx context.Context, pool *pgxpool.Pool) error {
+	start := time.Now()
+	log.Println("runMigrations: ensuring schema_migrations table")
+
+	if _, err := pool.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INT PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`); err != nil {
+		return err
+	}
+
+	current, err := appliedSchemaVersion(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	for i := current; i < len(migrations); i++ {
+		version := i + 1
+		log.Printf("runMigrations: applying version %d", version)
+
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, migrations[i]); err != nil {
+			_ = tx.Rollback(ctx)
+			return err
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			_ = tx.Rollback(ctx)
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("runMigrations: schema at version %d in %s", len(migrations), time.Since(start).String())
+	return nil
+}
+
+// appliedSchemaVersion reports the highest migration recorded in
+// schema_migrations.
+func appliedSchemaVersion(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var current int
+	err := pool.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	return current, err
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,7 +9,31 @@ import (
 )
 
 type server struct {
-	db *pgxpool.Pool
+	db  *pgxpool.Pool
+	cfg config
+
+	replica        *pgxpool.Pool
+	replicaHealthy atomic.Bool
+
+	regCache   *registrationCache
+	usersStale *usersStaleCache
+
+	// uploadSlots is a semaphore bounding concurrent upload handlers.
+	uploadSlots chan struct{}
+	uploads     uploadTracker
+
+	limiter *rateLimiter
+
+	breaker *dbBreaker
+
+	webhook *webhookNotifier
+
+	flags *featureFlags
+
+	// cvLocks serializes CV writes per user within this process, so a
+	// double-submitted upload waits for the first and then finds its hash
+	// already stored.
+	cvLocks stripedMutex
 }
 
 type User struct {
@@ -16,7 +41,11 @@ type User struct {
 	Name      *string   `json:"name,omitempty"`
 	Age       *int      `json:"age,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
-	HasCV     bool      `json:"-"` // internal flag to build download URL
+	HasCV     bool      `json:"has_cv"`
+
+	CvPageCount *int `json:"cv_page_count,omitempty"`
+	// CvUploadedAt is when the current CV was stored; nil without a CV.
+	CvUploadedAt *time.Time `json:"cv_uploaded_at,omitempty"`
 
 	CvFileDownloadURL *string `json:"cv_file_download_url,omitempty"`
 }
@@ -27,9 +56,56 @@ type Registration struct {
 	JobTitle       *string   `json:"job_title,omitempty"`
 	AddressFull    *string   `json:"address_full,omitempty"`
 	WhatsappNumber string    `json:"whatsapp_number"`
+	WhatsappLink   *string   `json:"whatsapp_link,omitempty"` // derived from WhatsappNumber, not stored
 	Note           *string   `json:"note,omitempty"`
 	ApplicantCount int       `json:"applicant_count"`
 	VisaType       *string   `json:"visa_type,omitempty"`
+	Status         string    `json:"status"`
 	CreatedAt      time.Time `json:"created_at"`
 	UpdatedAt      time.Time `json:"updated_at"`
+	// ArchivedAt is set once the registration has been archived for age.
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+}
+
+// registrationCursor marks the last row of a page for keyset pagination:
+// the sort it was issued for, that row's sort value and its id.
+type registrationCursor struct {
+	Sort           string    `json:"s"`
+	Desc           bool      `json:"d"`
+	Value          string    `json:"v"`
+	RegistrationID uuid.UUID `json:"id"`
+}
+
+type CVInfo struct {
+	UserID     int64      `json:"user_id"`
+	CVID       uuid.UUID  `json:"cv_id"`
+	Filename   string     `json:"filename"`
+	MimeType   string     `json:"mime_type"`
+	Size       int64      `json:"size"`
+	UploadedAt *time.Time `json:"uploaded_at,omitempty"`
+}
+
+// UserCV is one of a user's CVs, without the file itself. Exactly one CV of
+// a user who has any is primary; it is what GET /users/{id}/cv serves.
+type UserCV struct {
+	CVID       uuid.UUID `json:"cv_id"`
+	Filename   string    `json:"filename"`
+	MimeType   string    `json:"mime_type"`
+	Size       int64     `json:"size"`
+	PageCount  *int      `json:"page_count,omitempty"`
+	IsPrimary  bool      `json:"is_primary"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// listEnvelope is the v1 response shape for list endpoints.
+type listEnvelope struct {
+	Data any      `json:"data"`
+	Meta listMeta `json:"meta"`
+}
+
+type listMeta struct {
+	Total      int    `json:"total"`
+	Limit      int    `json:"limit"`
+	Offset     int    `json:"offset"`
+	NextCursor string `json:"next_cursor,omitempty"`
 }
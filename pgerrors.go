@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Postgres SQLSTATE codes we react to.
+const (
+	pgUniqueViolation      = "23505"
+	pgForeignKeyViolation  = "23503"
+	pgNotNullViolation     = "23502"
+	pgCheckViolation       = "23514"
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+	pgAdminShutdown        = "57P01"
+	pgCannotConnectNow     = "57P03"
+)
+
+// pgErrorCode returns the SQLSTATE of a Postgres error, or "" for anything else.
+func pgErrorCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// pgConstraintKey matches the column list in details like
+// "Key (whatsapp_number)=(+628123) already exists."
+var pgConstraintKey = regexp.MustCompile(`^Key \(([^)]+)\)=`)
+
+// constraintError is how a violated integrity constraint is reported to the
+// client.
+type constraintError struct {
+	Status int
+	Code   string
+	Field  string
+}
+
+// classifyConstraintViolation maps integrity constraint violations to client
+// errors: unique 409, foreign key 422, not-null and check 400. Only column or
+// constraint names are returned, never the offending value.
+func classifyConstraintViolation(err error) (constraintError, bool) {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return constraintError{}, false
+	}
+
+	var ce constraintError
+	switch pgErr.Code {
+	case pgUniqueViolation:
+		ce = constraintError{Status: http.StatusConflict, Code: "conflict"}
+	case pgForeignKeyViolation:
+		ce = constraintError{Status: http.StatusUnprocessableEntity, Code: "invalid_reference"}
+	case pgNotNullViolation, pgCheckViolation:
+		ce = constraintError{Status: http.StatusBadRequest, Code: "constraint_violation"}
+	default:
+		return constraintError{}, false
+	}
+
+	switch m := pgConstraintKey.FindStringSubmatch(pgErr.Detail); {
+	case m != nil:
+		ce.Field = m[1]
+	case pgErr.ColumnName != "":
+		ce.Field = pgErr.ColumnName
+	default:
+		ce.Field = pgErr.ConstraintName
+	}
+	return ce, true
+}
+
+// isTransientDBError reports errors that a fresh attempt can plausibly
+// succeed on: serialization failures, deadlocks, dropped or refused
+// connections and server restarts. Context cancellation is never transient.
+func isTransientDBError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch code := pgErrorCode(err); {
+	case code == pgSerializationFailure, code == pgDeadlockDetected,
+		code == pgAdminShutdown, code == pgCannotConnectNow,
+		strings.HasPrefix(code, "08"): // connection_exception class
+		return true
+	case code != "":
+		return false
+	}
+	return pgconn.SafeToRetry(err) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// readRetryBackoff is the wait before each retry of an idempotent read; its
+// length bounds the number of retries.
+var readRetryBackoff = []time.Duration{50 * time.Millisecond, 200 * time.Millisecond}
+
+// retryRead runs an idempotent read, retrying transient failures with a short
+// backoff. Only use it for reads: a write may have committed before the error.
+func retryRead[T any](ctx context.Context, op string, fn func() (T, error)) (T, error) {
+	v, err := fn()
+	for _, wait := range readRetryBackoff {
+		if !isTransientDBError(err) {
+			break
+		}
+		log.Printf("%s: transient error, retrying in %s: %v", op, wait, err)
+		dbReadRetries.WithLabelValues(op).Inc()
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return v, err
+		}
+		v, err = fn()
+	}
+	return v, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 1024
+)
+
+// registrationQRHandler renders a PNG QR code of the registration's detail
+// URL for applicants to show at the office.
+func (s *server) registrationQRHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("registrationQR start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, OPTIONS")
+		return
+	}
+
+	size := defaultQRSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid_size", "min": minQRSize, "max": maxQRSize})
+			return
+		}
+		size = n
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if _, err := s.getRegistrationByID(ctx, registrationID); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if errors.Is(err, errRegistrationNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+			return
+		}
+		writeServerError(w, r, "registrationQR fetch", err)
+		return
+	}
+
+	code, err := qrcode.New(s.publicURL(r, "/registrations/"+registrationID.String()), qrcode.Medium)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeServerError(w, r, "registrationQR encode", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := code.Write(size, &buf); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		writeServerError(w, r, "registrationQR render", err)
+		return
+	}
+
+	// the image only changes if the URL or size does, so it caches well
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:8]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("registrationQR write failed: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a per-client token bucket: each client may burst up to
+// `burst` requests and regains `rate` tokens per second. A nil *rateLimiter
+// lets everything through.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimitState is the bucket state after a request was counted, used for
+// the X-RateLimit-* headers.
+type rateLimitState struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the next token, when not allowed
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 || burst <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (l *rateLimiter) allow(key string, now time.Time) rateLimitState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	st := rateLimitState{limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		st.allowed = true
+	} else {
+		st.retryAfter = l.secondsFor(1 - b.tokens)
+	}
+	st.remaining = int(b.tokens)
+	st.reset = l.secondsFor(l.burst - b.tokens)
+	return st
+}
+
+func (l *rateLimiter) secondsFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely; they are
+// indistinguishable from new ones. Runs at most once a minute.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	full := l.secondsFor(l.burst)
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit applies the limiter per client IP. Every limited response carries
+// X-RateLimit-Limit/Remaining/Reset (Reset in seconds until the bucket is
+// full); rejected requests get 429 with Retry-After and the same numbers in
+// the body.
+func (s *server) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		st := s.limiter.allow(s.clientIP(r), time.Now())
+		reset := ceilSeconds(st.reset)
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(st.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(st.remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(reset))
+		if st.allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		retryAfter := max(1, ceilSeconds(st.retryAfter))
+		log.Printf("rate limited: method=%s path=%s remote=%s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":       "rate_limited",
+			"limit":       st.limit,
+			"remaining":   st.remaining,
+			"reset":       reset,
+			"retry_after": retryAfter,
+		})
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP is the address the rate limiter keys on. Behind
+// TRUSTED_PROXY_HOPS proxies every connection comes from the last proxy, so
+// the client is the X-Forwarded-For entry the outermost trusted proxy
+// appended, counting from the right; entries further left are whatever the
+// client chose to send and can't be trusted.
+func (s *server) clientIP(r *http.Request) string {
+	if hops := s.cfg.TrustedProxyHops; hops > 0 {
+		var forwarded []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(v, ",") {
+				if hop = strings.TrimSpace(hop); hop != "" {
+					forwarded = append(forwarded, hop)
+				}
+			}
+		}
+		if len(forwarded) >= hops {
+			return forwarded[len(forwarded)-hops]
+		}
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return client
+}
@@ -3,63 +3,358 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
 	errUserNotFound         = errors.New("user not found")
 	errRegistrationNotFound = errors.New("registration not found")
 	errFileNotFound         = errors.New("file not found")
+	errFileDeleted          = errors.New("file deleted")
+	errCVNotFound           = errors.New("cv not found")
+	errCVVersionNotFound    = errors.New("cv version not found")
+	errUploadNotFound       = errors.New("upload session not found")
+	errUploadOffsetMismatch = errors.New("upload offset mismatch")
+	errUploadClaimed        = errors.New("upload session already being finalized")
+
+	errRegistrationLimitReached = errors.New("registration limit reached for whatsapp number")
+	errPreconditionFailed       = errors.New("precondition failed")
 )
 
-func (s *server) fetchUsers(ctx context.Context) ([]User, error) {
+// storageQuotaError reports that a registration has no room for another file.
+type storageQuotaError struct {
+	Usage int64
+	Limit int64
+}
+
+func (e *storageQuotaError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: usage=%d limit=%d", e.Usage, e.Limit)
+}
+
+// readDB returns the pool read-only queries should use: the replica when one
+// is configured and passing health checks, otherwise the primary.
+func (s *server) readDB() *pgxpool.Pool {
+	if s.replica != nil && s.replicaHealthy.Load() {
+		return s.replica
+	}
+	return s.db
+}
+
+// monitorReplica pings the replica periodically and flips reads back to the
+// primary while it is unreachable.
+func (s *server) monitorReplica(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := s.replica.Ping(pingCtx)
+		cancel()
+
+		healthy := err == nil
+		if s.replicaHealthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Println("monitorReplica: replica healthy, routing reads to replica")
+			} else {
+				log.Printf("monitorReplica: replica unhealthy, routing reads to primary: %v", err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type poolStatsLog struct {
+	Level               string  `json:"level"`
+	Msg                 string  `json:"msg"`
+	Acquired            int32   `json:"acquired"`
+	Idle                int32   `json:"idle"`
+	Max                 int32   `json:"max"`
+	Utilization         float64 `json:"utilization"`
+	CanceledAcquires    int64   `json:"canceled_acquires"`
+	EmptyAcquires       int64   `json:"empty_acquires"`
+	EmptyAcquiresDelta  int64   `json:"empty_acquires_delta"`
+	AcquireWaitDuration string  `json:"acquire_wait_duration"`
+}
+
+// monitorPool logs pool.Stat() as JSON every interval. It logs at WARN when
+// utilization crosses warnAt or when acquires had to wait since the last tick,
+// which is the early sign that MaxConns is too low.
+func monitorPool(ctx context.Context, pool *pgxpool.Pool, interval time.Duration, warnAt float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastEmpty int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		st := pool.Stat()
+		entry := poolStatsLog{
+			Level:               "INFO",
+			Msg:                 "db pool stats",
+			Acquired:            st.AcquiredConns(),
+			Idle:                st.IdleConns(),
+			Max:                 st.MaxConns(),
+			CanceledAcquires:    st.CanceledAcquireCount(),
+			EmptyAcquires:       st.EmptyAcquireCount(),
+			EmptyAcquiresDelta:  st.EmptyAcquireCount() - lastEmpty,
+			AcquireWaitDuration: st.AcquireDuration().String(),
+		}
+		lastEmpty = st.EmptyAcquireCount()
+
+		if entry.Max > 0 {
+			entry.Utilization = float64(entry.Acquired) / float64(entry.Max)
+		}
+		if entry.Utilization >= warnAt || entry.EmptyAcquiresDelta > 0 {
+			entry.Level = "WARN"
+			entry.Msg = "db pool saturated"
+		}
+
+		b, err := json.Marshal(entry)
+		if err != nil {
+			log.Printf("monitorPool: encode failed: %v", err)
+			continue
+		}
+		log.Println(string(b))
+	}
+}
+
+// rowCeilingLimit is the LIMIT to query with so no list returns more than
+// MAX_RESULT_ROWS, whatever limit reached it. Past the ceiling one extra row
+// is asked for, so truncateToCeiling can tell a truncated page from an exact
+// fit. This is a backstop behind pagination validation, not a replacement.
+func (s *server) rowCeilingLimit(limit int) int {
+	ceiling := s.cfg.MaxResultRows
+	if ceiling <= 0 || (limit > 0 && limit <= ceiling) {
+		return limit
+	}
+	return ceiling + 1
+}
+
+// truncateToCeiling cuts rows fetched with rowCeilingLimit back to the
+// ceiling, logging at WARN when that drops anything.
+func truncateToCeiling[T any](s *server, op string, requested int, rows []T) []T {
+	ceiling := s.cfg.MaxResultRows
+	if ceiling <= 0 || len(rows) <= ceiling {
+		return rows
+	}
+	warnCeilingTruncated(op, ceiling, requested)
+	return rows[:ceiling]
+}
+
+// warnCeilingTruncated logs that the row ceiling cut op's result short.
+func warnCeilingTruncated(op string, ceiling, requested int) {
+	log.Printf("WARN %s: result row ceiling %d truncated query (requested %d)", op, ceiling, requested)
+}
+
+type listUsersParams struct {
+	// Limit of 0 returns every user.
+	Limit  int
+	Offset int
+	// Sort is a key of userSortColumns; "" sorts by id.
+	Sort string
+	Desc bool
+}
+
+// userSortColumns maps the accepted ?sort= values to their SQL expression.
+// Only these literals ever reach the ORDER BY clause.
+var userSortColumns = map[string]string{
+	"id":         "id",
+	"created_at": "created_at",
+	"name":       "name",
+}
+
+// userNullableSortColumns are the user sort columns that may hold NULL.
+var userNullableSortColumns = map[string]bool{"name": true}
+
+// orderTerm renders one ORDER BY term. Nullable columns always sort NULLS
+// LAST, so users without a name trail the list in both directions instead of
+// leading it on DESC. NOT NULL columns leave the clause off so a plain index
+// can still serve the scan backwards.
+func orderTerm(column, dir string, nullable bool) string {
+	if nullable {
+		return column + " " + dir + " NULLS LAST"
+	}
+	return column + " " + dir
+}
+
+func (p listUsersParams) orderBy() string {
+	col, ok := userSortColumns[p.Sort]
+	if !ok {
+		col = "id"
+	}
+	dir := "ASC"
+	if p.Desc {
+		dir = "DESC"
+	}
+	if col == "id" {
+		return "id " + dir
+	}
+	// id breaks ties so equal names or timestamps keep a stable order
+	return orderTerm(col, dir, userNullableSortColumns[p.Sort]) + ", id " + dir
+}
+
+func (s *server) fetchUsers(ctx context.Context, p listUsersParams) ([]User, error) {
+	return retryRead(ctx, "fetchUsers", func() ([]User, error) { return s.fetchUsersOnce(ctx, p) })
+}
+
+func (s *server) fetchUsersOnce(ctx context.Context, p listUsersParams) ([]User, error) {
 	start := time.Now()
-	log.Println("fetchUsers: running SELECT id, name, age, created_at, cv_file IS NOT NULL FROM users")
-	rows, err := s.db.Query(ctx, `SELECT id, name, age, created_at, cv_file IS NOT NULL AS has_cv FROM users`)
+	users := make([]User, 0)
+	err := s.streamUsers(ctx, p, func(u User) error {
+		users = append(users, u)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	log.Printf("fetchUsers: fetched %d rows in %s", len(users), time.Since(start).String())
+	return users, nil
+}
+
+// userColumns is the select list scanUser reads, from userTables. The CV
+// columns describe the user's primary CV.
+const userColumns = `id, name, age, created_at, primary_cv.cv_id IS NOT NULL AS has_cv, primary_cv.page_count, primary_cv.uploaded_at`
+
+const userTables = `users LEFT JOIN user_cvs primary_cv ON primary_cv.user_id = users.id AND primary_cv.is_primary`
+
+// streamUsers hands each user to fn as it is read from the cursor, so callers
+// that write rows out directly never hold the whole table in memory. Like
+// every list it stops at MAX_RESULT_ROWS, logging at WARN when that cuts
+// the result short.
+func (s *server) streamUsers(ctx context.Context, p listUsersParams, fn func(User) error) error {
+	log.Println("streamUsers: running SELECT id, name, age, created_at, primary CV metadata FROM users LEFT JOIN user_cvs")
+
+	requested := p.Limit
+	p.Limit = s.rowCeilingLimit(p.Limit)
+	query := `SELECT ` + userColumns + ` FROM ` + userTables + ` ORDER BY ` + p.orderBy()
+	var args []any
+	if p.Limit > 0 {
+		query += ` LIMIT $1 OFFSET $2`
+		args = append(args, p.Limit, p.Offset)
+	}
+
+	rows, err := s.readDB().Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
 	defer rows.Close()
 
-	users := make([]User, 0)
+	n := 0
 	for rows.Next() {
-		var (
-			u    User
-			name sql.NullString
-			age  sql.NullInt32
-			cv   bool
-		)
-
-		if err := rows.Scan(&u.ID, &name, &age, &u.CreatedAt, &cv); err != nil {
-			return nil, err
+		if ceiling := s.cfg.MaxResultRows; ceiling > 0 && n == ceiling {
+			warnCeilingTruncated("streamUsers", ceiling, requested)
+			return nil
 		}
-
-		if name.Valid {
-			u.Name = &name.String
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
 		}
-
-		if age.Valid {
-			v := int(age.Int32)
-			u.Age = &v
+		if err := fn(u); err != nil {
+			return err
 		}
+		n++
+	}
 
-		u.HasCV = cv
-		users = append(users, u)
+	return rows.Err()
+}
+
+// scanUser reads one row selected with userColumns.
+func scanUser(row pgx.Row) (User, error) {
+	var (
+		u         User
+		name      sql.NullString
+		age       sql.NullInt32
+		cv        bool
+		pageCount sql.NullInt32
+		cvUpdated sql.NullTime
+	)
+
+	if err := row.Scan(&u.ID, &name, &age, &u.CreatedAt, &cv, &pageCount, &cvUpdated); err != nil {
+		return User{}, err
 	}
 
-	if err := rows.Err(); err != nil {
+	if name.Valid {
+		u.Name = &name.String
+	}
+
+	if age.Valid {
+		v := int(age.Int32)
+		u.Age = &v
+	}
+
+	if pageCount.Valid {
+		v := int(pageCount.Int32)
+		u.CvPageCount = &v
+	}
+
+	u.CreatedAt = u.CreatedAt.UTC()
+	u.HasCV = cv
+	if cv && cvUpdated.Valid {
+		t := cvUpdated.Time.UTC()
+		u.CvUploadedAt = &t
+	}
+	return u, nil
+}
+
+// fetchUsersByIDs returns the users among ids, ordered by id; ids that don't
+// exist are simply absent.
+func (s *server) fetchUsersByIDs(ctx context.Context, ids []int64) ([]User, error) {
+	start := time.Now()
+	log.Printf("fetchUsersByIDs: running SELECT ... FROM users WHERE id = ANY($1) for %d ids", len(ids))
+
+	users, err := retryRead(ctx, "fetchUsersByIDs", func() ([]User, error) {
+		rows, err := s.readDB().Query(ctx, `SELECT `+userColumns+` FROM `+userTables+` WHERE id = ANY($1) ORDER BY id`, ids)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		users := make([]User, 0, len(ids))
+		for rows.Next() {
+			u, err := scanUser(rows)
+			if err != nil {
+				return nil, err
+			}
+			users = append(users, u)
+		}
+		return users, rows.Err()
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("fetchUsers: fetched %d rows in %s", len(users), time.Since(start).String())
+	log.Printf("fetchUsersByIDs: fetched %d of %d in %s", len(users), len(ids), time.Since(start).String())
 	return users, nil
 }
 
+func (s *server) countUsers(ctx context.Context) (int, error) {
+	var n int
+	err := s.readDB().QueryRow(ctx, `SELECT COUNT(*) FROM users`).Scan(&n)
+	return n, err
+}
+
 func (s *server) insertUser(ctx context.Context, req createUserRequest) (User, error) {
 	start := time.Now()
 	log.Println("insertUser: running INSERT INTO users (name, age) VALUES ($1, $2) RETURNING id, name, age, created_at")
@@ -85,68 +380,452 @@ func (s *server) insertUser(ctx context.Context, req createUserRequest) (User, e
 		u.Age = &v
 	}
 
+	u.CreatedAt = u.CreatedAt.UTC()
+
 	log.Printf("insertUser: inserted id=%d in %s", u.ID, time.Since(start).String())
 	return u, nil
 }
 
-func (s *server) saveUserCV(ctx context.Context, userID int64, cvData []byte) error {
+// saveUserCV stores a CV for the user and returns its id. By default it
+// replaces the primary CV, archiving the one it replaces into cv_history in
+// the same transaction; with additional set it adds another CV alongside,
+// which only becomes primary when the user has none. pageCount is nil when it
+// couldn't be determined. Bytes identical to the CV they would replace (or,
+// when adding, to any of the user's CVs) are not written again; changed
+// reports whether anything was stored.
+func (s *server) saveUserCV(ctx context.Context, userID int64, cvData []byte, filename, mimeType string, pageCount *int, additional bool) (cvID uuid.UUID, changed bool, err error) {
 	start := time.Now()
-	log.Println("saveUserCV: running UPDATE users SET cv_file")
+	log.Printf("saveUserCV: storing CV in user_cvs additional=%t", additional)
 
-	tag, err := s.db.Exec(ctx, `UPDATE users SET cv_file = $2 WHERE id = $1`, userID, cvData)
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return err
+		return uuid.Nil, false, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// the user row lock serializes every change to which CV is primary
+	var found int
+	if err := tx.QueryRow(ctx, `SELECT 1 FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&found); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, false, errUserNotFound
+		}
+		return uuid.Nil, false, err
+	}
+
+	hash := contentHash(cvData)
+	var (
+		primaryID   uuid.UUID
+		primaryHash sql.NullString
+		hasPrimary  = true
+	)
+	if err := tx.QueryRow(ctx, `
+		SELECT cv_id, hash FROM user_cvs WHERE user_id = $1 AND is_primary
+	`, userID).Scan(&primaryID, &primaryHash); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, false, err
+		}
+		hasPrimary = false
+	}
+
+	if s.isEnabled(flagCVDedup) {
+		if !additional && primaryHash.Valid && primaryHash.String == hash {
+			log.Printf("saveUserCV: CV for user=%d unchanged, skipping write in %s", userID, time.Since(start).String())
+			return primaryID, false, nil
+		}
+		if additional {
+			var existing uuid.UUID
+			err := tx.QueryRow(ctx, `SELECT cv_id FROM user_cvs WHERE user_id = $1 AND hash = $2 LIMIT 1`, userID, hash).Scan(&existing)
+			if err == nil {
+				log.Printf("saveUserCV: CV for user=%d already stored as %s, skipping write in %s", userID, existing.String(), time.Since(start).String())
+				return existing, false, nil
+			}
+			if !errors.Is(err, pgx.ErrNoRows) {
+				return uuid.Nil, false, err
+			}
+		}
+	}
+
+	stored, compressed := s.compressForStorage(cvData, mimeType)
+	if hasPrimary && !additional {
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO cv_history (user_id, cv_file, cv_compressed, cv_filename, cv_mime_type, cv_size, cv_hash, uploaded_at)
+			SELECT user_id, data, compressed, filename, mime_type, size, hash, uploaded_at
+			FROM user_cvs
+			WHERE cv_id = $1
+		`, primaryID); err != nil {
+			return uuid.Nil, false, err
+		}
+		if _, err := tx.Exec(ctx, `
+			UPDATE user_cvs
+			SET data = $2, compressed = $3, filename = $4, mime_type = $5, size = $6, hash = $7,
+				page_count = $8, uploaded_at = now()
+			WHERE cv_id = $1
+		`, primaryID, stored, compressed, filename, mimeType, int64(len(cvData)), hash, pageCount); err != nil {
+			return uuid.Nil, false, err
+		}
+		cvID = primaryID
+	} else {
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO user_cvs (user_id, data, compressed, filename, mime_type, size, hash, page_count, is_primary)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING cv_id
+		`, userID, stored, compressed, filename, mimeType, int64(len(cvData)), hash, pageCount, !hasPrimary).Scan(&cvID); err != nil {
+			return uuid.Nil, false, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return uuid.Nil, false, err
+	}
+
+	log.Printf("saveUserCV: saved CV %s for user=%d in %s", cvID.String(), userID, time.Since(start).String())
+	return cvID, true, nil
+}
+
+// listUserCVs returns the metadata of every CV the user has, primary first
+// and then newest first.
+func (s *server) listUserCVs(ctx context.Context, userID int64) ([]UserCV, error) {
+	start := time.Now()
+	log.Println("listUserCVs: running SELECT cv metadata FROM user_cvs WHERE user_id=$1")
+
+	var exists bool
+	if err := s.readDB().QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errUserNotFound
+	}
+
+	rows, err := s.readDB().Query(ctx, `
+		SELECT cv_id, filename, mime_type, COALESCE(size, octet_length(data)), page_count, is_primary, uploaded_at
+		FROM user_cvs
+		WHERE user_id = $1
+		ORDER BY is_primary DESC, uploaded_at DESC, cv_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cvs := make([]UserCV, 0)
+	for rows.Next() {
+		var (
+			cv        UserCV
+			filename  sql.NullString
+			mimeType  sql.NullString
+			pageCount sql.NullInt32
+		)
+		if err := rows.Scan(&cv.CVID, &filename, &mimeType, &cv.Size, &pageCount, &cv.IsPrimary, &cv.UploadedAt); err != nil {
+			return nil, err
+		}
+		cv.Filename = cvFilename(userID, filename)
+		cv.MimeType = cvMimeType(mimeType)
+		if pageCount.Valid {
+			v := int(pageCount.Int32)
+			cv.PageCount = &v
+		}
+		cv.UploadedAt = cv.UploadedAt.UTC()
+		cvs = append(cvs, cv)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("listUserCVs: fetched %d CVs for user=%d in %s", len(cvs), userID, time.Since(start).String())
+	return cvs, nil
+}
+
+// cvFilename is the stored filename, or a generated one for CVs uploaded
+// before filenames were kept.
+func cvFilename(userID int64, filename sql.NullString) string {
+	if filename.Valid && filename.String != "" {
+		return filename.String
+	}
+	return "cv-" + strconv.FormatInt(userID, 10) + ".pdf"
+}
+
+func cvMimeType(mimeType sql.NullString) string {
+	if mimeType.Valid && mimeType.String != "" {
+		return mimeType.String
 	}
+	return "application/pdf"
+}
+
+func (s *server) deleteCVHistoryEntry(ctx context.Context, userID int64, versionID uuid.UUID) error {
+	start := time.Now()
+	log.Println("deleteCVHistoryEntry: running DELETE FROM cv_history WHERE user_id=$1 AND version_id=$2")
 
+	tag, err := s.db.Exec(ctx, `DELETE FROM cv_history WHERE user_id = $1 AND version_id = $2`, userID, versionID)
+	if err != nil {
+		return err
+	}
 	if tag.RowsAffected() == 0 {
-		return errUserNotFound
+		return errCVVersionNotFound
 	}
 
-	log.Printf("saveUserCV: saved CV for user=%d in %s", userID, time.Since(start).String())
+	log.Printf("deleteCVHistoryEntry: deleted version=%s for user=%d in %s", versionID.String(), userID, time.Since(start).String())
 	return nil
 }
 
-func (s *server) getUserCV(ctx context.Context, userID int64) ([]byte, error) {
+// clearCVHistory removes every archived CV for a user, leaving the current CV.
+func (s *server) clearCVHistory(ctx context.Context, userID int64) (int64, error) {
+	start := time.Now()
+	log.Println("clearCVHistory: running DELETE FROM cv_history WHERE user_id=$1")
+
+	var exists bool
+	if err := s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, errUserNotFound
+	}
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM cv_history WHERE user_id = $1`, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Printf("clearCVHistory: deleted %d versions for user=%d in %s", tag.RowsAffected(), userID, time.Since(start).String())
+	return tag.RowsAffected(), nil
+}
+
+// cvPurgeSummary reports what purgeUserCV erased.
+type cvPurgeSummary struct {
+	UserID                int64     `json:"user_id"`
+	CVRemoved             bool      `json:"cv_removed"`
+	CVsRemoved            int64     `json:"cvs_removed"`
+	CVBytes               int64     `json:"cv_bytes"`
+	HistoryRemoved        int64     `json:"history_removed"`
+	UploadSessionsRemoved int64     `json:"upload_sessions_removed"`
+	AuditID               uuid.UUID `json:"audit_id"`
+}
+
+// purgeUserCV erases a user's CVs for a data-erasure request: every CV in
+// user_cvs, the legacy copy in the users.cv_* columns, every archived
+// version, and any unfinished CV upload, in one transaction that also writes
+// the audit_log entry. The per-user size override is a setting,
+// not CV data, and is kept.
+func (s *server) purgeUserCV(ctx context.Context, userID int64, requestID string) (cvPurgeSummary, error) {
 	start := time.Now()
-	log.Println("getUserCV: running SELECT cv_file FROM users WHERE id=$1")
+	log.Println("purgeUserCV: erasing user_cvs, users.cv_*, cv_history and CV upload sessions in a transaction")
 
-	var cv []byte
-	err := s.db.QueryRow(ctx, `SELECT cv_file FROM users WHERE id = $1`, userID).Scan(&cv)
+	tx, err := s.db.Begin(ctx)
 	if err != nil {
+		return cvPurgeSummary{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	summary := cvPurgeSummary{UserID: userID}
+	var (
+		legacyCV    bool
+		legacyBytes int64
+	)
+	if err := tx.QueryRow(ctx, `
+		SELECT cv_file IS NOT NULL, CASE WHEN cv_file IS NULL THEN 0 ELSE COALESCE(cv_size, octet_length(cv_file)) END
+		FROM users WHERE id = $1 FOR UPDATE
+	`, userID).Scan(&legacyCV, &legacyBytes); err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
-			return nil, errUserNotFound
+			return cvPurgeSummary{}, errUserNotFound
 		}
-		return nil, err
+		return cvPurgeSummary{}, err
 	}
 
-	log.Printf("getUserCV: fetched CV for user=%d in %s", userID, time.Since(start).String())
-	return cv, nil
+	if err := tx.QueryRow(ctx, `
+		WITH removed AS (
+			DELETE FROM user_cvs WHERE user_id = $1
+			RETURNING COALESCE(size, octet_length(data)) AS size
+		)
+		SELECT count(*), COALESCE(sum(size), 0)::bigint FROM removed
+	`, userID).Scan(&summary.CVsRemoved, &summary.CVBytes); err != nil {
+		return cvPurgeSummary{}, err
+	}
+
+	// migration 18 left the users.cv_* columns for rollback, and a previous
+	// release may still be writing them
+	if _, err := tx.Exec(ctx, `
+		UPDATE users
+		SET cv_file = NULL, cv_filename = NULL, cv_mime_type = NULL, cv_size = NULL, cv_hash = NULL,
+			cv_page_count = NULL, cv_compressed = false, cv_updated_at = NULL
+		WHERE id = $1
+	`, userID); err != nil {
+		return cvPurgeSummary{}, err
+	}
+	summary.CVBytes += legacyBytes
+	summary.CVRemoved = summary.CVsRemoved > 0 || legacyCV
+
+	tag, err := tx.Exec(ctx, `DELETE FROM cv_history WHERE user_id = $1`, userID)
+	if err != nil {
+		return cvPurgeSummary{}, err
+	}
+	summary.HistoryRemoved = tag.RowsAffected()
+
+	tag, err = tx.Exec(ctx, `DELETE FROM upload_session WHERE user_id = $1 AND target = $2`, userID, uploadTargetCV)
+	if err != nil {
+		return cvPurgeSummary{}, err
+	}
+	summary.UploadSessionsRemoved = tag.RowsAffected()
+
+	details, err := json.Marshal(map[string]any{
+		"cv_removed":              summary.CVRemoved,
+		"cvs_removed":             summary.CVsRemoved,
+		"cv_bytes":                summary.CVBytes,
+		"history_removed":         summary.HistoryRemoved,
+		"upload_sessions_removed": summary.UploadSessionsRemoved,
+	})
+	if err != nil {
+		return cvPurgeSummary{}, err
+	}
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO audit_log (action, user_id, details, request_id)
+		VALUES ('cv_erasure', $1, $2, $3)
+		RETURNING audit_id
+	`, userID, details, requestID).Scan(&summary.AuditID); err != nil {
+		return cvPurgeSummary{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return cvPurgeSummary{}, err
+	}
+
+	log.Printf("purgeUserCV: purged CV for user=%d history=%d audit_id=%s in %s", userID, summary.HistoryRemoved, summary.AuditID.String(), time.Since(start).String())
+	return summary, nil
 }
 
-func (s *server) insertRegistration(ctx context.Context, req createRegistrationRequest) (Registration, error) {
+// cvUploadLimit returns the largest CV the user may upload: their
+// cv_max_bytes override when set, else the global maxUploadSize.
+func (s *server) cvUploadLimit(ctx context.Context, userID int64) (int64, error) {
+	var override sql.NullInt64
+	if err := s.readDB().QueryRow(ctx, `SELECT cv_max_bytes FROM users WHERE id = $1`, userID).Scan(&override); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, errUserNotFound
+		}
+		return 0, err
+	}
+	if override.Valid && override.Int64 > 0 {
+		return override.Int64, nil
+	}
+	return maxUploadSize, nil
+}
+
+// getUserCVInfo returns the primary CV's metadata without reading the blob.
+// CVs uploaded before the metadata columns existed fall back to derived
+// values.
+func (s *server) getUserCVInfo(ctx context.Context, userID int64) (CVInfo, error) {
+	start := time.Now()
+	log.Println("getUserCVInfo: running SELECT primary cv metadata FROM users LEFT JOIN user_cvs WHERE id=$1")
+
+	var (
+		info       CVInfo
+		cvID       *uuid.UUID
+		filename   sql.NullString
+		mimeType   sql.NullString
+		uploadedAt sql.NullTime
+	)
+	err := s.readDB().QueryRow(ctx, `
+		SELECT users.id, primary_cv.cv_id, primary_cv.filename, primary_cv.mime_type,
+			COALESCE(primary_cv.size, octet_length(primary_cv.data), 0), primary_cv.uploaded_at
+		FROM `+userTables+`
+		WHERE users.id = $1
+	`, userID).Scan(&info.UserID, &cvID, &filename, &mimeType, &info.Size, &uploadedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return CVInfo{}, errUserNotFound
+		}
+		return CVInfo{}, err
+	}
+
+	if cvID == nil {
+		return CVInfo{}, errCVNotFound
+	}
+
+	info.CVID = *cvID
+	info.Filename = cvFilename(userID, filename)
+	info.MimeType = cvMimeType(mimeType)
+	if uploadedAt.Valid {
+		t := uploadedAt.Time.UTC()
+		info.UploadedAt = &t
+	}
+
+	log.Printf("getUserCVInfo: fetched CV info for user=%d in %s", userID, time.Since(start).String())
+	return info, nil
+}
+
+// storedCV is one of a user's CVs with the hash recorded at upload; Hash is
+// nil for CVs stored before hashing was added.
+type storedCV struct {
+	CVID     uuid.UUID
+	Data     []byte
+	Hash     *string
+	Filename string
+	MimeType string
+}
+
+// getUserCV returns the CV cvID of the user, or their primary CV when cvID is
+// uuid.Nil.
+func (s *server) getUserCV(ctx context.Context, userID int64, cvID uuid.UUID) (storedCV, error) {
+	return retryRead(ctx, "getUserCV", func() (storedCV, error) { return s.getUserCVOnce(ctx, userID, cvID) })
+}
+
+func (s *server) getUserCVOnce(ctx context.Context, userID int64, cvID uuid.UUID) (storedCV, error) {
 	start := time.Now()
-	log.Println("insertRegistration: running INSERT INTO registration")
+	log.Println("getUserCV: running SELECT data FROM users LEFT JOIN user_cvs WHERE id=$1")
 
-	applicantCount := 1
-	if req.ApplicantCount != nil {
-		applicantCount = *req.ApplicantCount
+	match := "c.is_primary"
+	args := []any{userID}
+	if cvID != uuid.Nil {
+		match = "c.cv_id = $2"
+		args = append(args, cvID)
 	}
 
-	row := s.db.QueryRow(ctx, `
-		INSERT INTO registration (
-			full_name, job_title, address_full, whatsapp_number, note, applicant_count, visa_type
-		) VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING registration_id, full_name, job_title, address_full, whatsapp_number, note, applicant_count, visa_type, created_at, updated_at
-	`,
-		req.FullName, req.JobTitle, req.AddressFull, req.WhatsappNumber, req.Note, applicantCount, req.VisaType,
+	var (
+		cv                 storedCV
+		hash               sql.NullString
+		compressed         sql.NullBool
+		filename, mimeType sql.NullString
+		servedID           uuid.NullUUID
 	)
+	err := s.readDB().QueryRow(ctx, `
+		SELECT c.cv_id, c.data, c.compressed, c.hash, c.filename, c.mime_type
+		FROM users LEFT JOIN user_cvs c ON c.user_id = users.id AND `+match+`
+		WHERE users.id = $1
+	`, args...).Scan(&servedID, &cv.Data, &compressed, &hash, &filename, &mimeType)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storedCV{}, errUserNotFound
+		}
+		return storedCV{}, err
+	}
+	if !compressed.Valid {
+		return storedCV{}, errCVNotFound
+	}
+	cv.CVID = servedID.UUID
+	if hash.Valid {
+		cv.Hash = &hash.String
+	}
+	cv.Filename = cvFilename(userID, filename)
+	cv.MimeType = cvMimeType(mimeType)
+
+	if compressed.Bool && len(cv.Data) > 0 {
+		if cv.Data, err = decompress(cv.Data); err != nil {
+			return storedCV{}, err
+		}
+	}
+
+	log.Printf("getUserCV: fetched CV for user=%d in %s", userID, time.Since(start).String())
+	return cv, nil
+}
 
+const registrationColumns = `registration_id, full_name, job_title, address_full, whatsapp_number, note, applicant_count, visa_type, status, created_at, updated_at, archived_at`
+
+// scanRegistration reads one row selected with registrationColumns.
+func scanRegistration(row pgx.Row) (Registration, error) {
 	var (
 		r           Registration
 		jobTitle    sql.NullString
 		addressFull sql.NullString
 		note        sql.NullString
 		visaType    sql.NullString
+		archivedAt  sql.NullTime
 	)
 
 	if err := row.Scan(
@@ -158,8 +837,10 @@ func (s *server) insertRegistration(ctx context.Context, req createRegistrationR
 		&note,
 		&r.ApplicantCount,
 		&visaType,
+		&r.Status,
 		&r.CreatedAt,
 		&r.UpdatedAt,
+		&archivedAt,
 	); err != nil {
 		return Registration{}, err
 	}
@@ -176,39 +857,182 @@ func (s *server) insertRegistration(ctx context.Context, req createRegistrationR
 	if visaType.Valid {
 		r.VisaType = &visaType.String
 	}
+	r.CreatedAt = r.CreatedAt.UTC()
+	r.UpdatedAt = r.UpdatedAt.UTC()
+	if archivedAt.Valid {
+		t := archivedAt.Time.UTC()
+		r.ArchivedAt = &t
+	}
+
+	if normalized, ok := normalizeWhatsappNumber(r.WhatsappNumber); ok {
+		link := "https://wa.me/" + strings.TrimPrefix(normalized, "+")
+		r.WhatsappLink = &link
+	}
 
-	log.Printf("insertRegistration: inserted id=%s in %s", r.RegistrationID.String(), time.Since(start).String())
 	return r, nil
 }
 
-func (s *server) getRegistrationByID(ctx context.Context, id uuid.UUID) (Registration, error) {
-	start := time.Now()
-	log.Println("getRegistrationByID: running SELECT ... FROM registration WHERE registration_id=$1")
+const insertRegistrationSQL = `
+	INSERT INTO registration (
+		full_name, job_title, address_full, whatsapp_number, note, applicant_count, visa_type
+	) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	RETURNING ` + registrationColumns
 
-	var (
-		r           Registration
-		jobTitle    sql.NullString
-		addressFull sql.NullString
-		note        sql.NullString
-		visaType    sql.NullString
-	)
+func insertRegistrationArgs(req createRegistrationRequest) []any {
+	return []any{req.FullName, req.JobTitle, req.AddressFull, req.WhatsappNumber, req.Note, req.applicantCount(), req.VisaType}
+}
 
-	err := s.db.QueryRow(ctx, `
-		SELECT registration_id, full_name, job_title, address_full, whatsapp_number, note, applicant_count, visa_type, created_at, updated_at
+func (s *server) insertRegistration(ctx context.Context, req createRegistrationRequest) (Registration, error) {
+	start := time.Now()
+	log.Println("insertRegistration: running INSERT INTO registration in a transaction")
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Registration{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := s.checkWhatsappLimit(ctx, tx, req.WhatsappNumber, 1); err != nil {
+		return Registration{}, err
+	}
+
+	r, err := scanRegistration(tx.QueryRow(ctx, insertRegistrationSQL, insertRegistrationArgs(req)...))
+	if err != nil {
+		return Registration{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Registration{}, err
+	}
+
+	log.Printf("insertRegistration: inserted id=%s in %s", r.RegistrationID.String(), time.Since(start).String())
+	return r, nil
+}
+
+// checkWhatsappLimit fails with errRegistrationLimitReached when adding more
+// active registrations for number would pass MAX_REGISTRATIONS_PER_WHATSAPP.
+// The advisory lock it takes serializes writes for one number, so concurrent
+// requests can't all pass the count; it is released when tx ends.
+func (s *server) checkWhatsappLimit(ctx context.Context, tx pgx.Tx, number string, adding int) error {
+	limit := s.cfg.MaxRegistrationsPerWhatsapp
+	if limit <= 0 {
+		return nil
+	}
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('registration_whatsapp:' || $1))`, number); err != nil {
+		return err
+	}
+	var active int
+	if err := tx.QueryRow(ctx, `
+		SELECT count(*) FROM registration WHERE whatsapp_number = $1 AND status <> ALL($2)
+	`, number, s.cfg.RegistrationLimitExemptStatuses).Scan(&active); err != nil {
+		return err
+	}
+	if active+adding > limit {
+		log.Printf("checkWhatsappLimit: %d active registrations for number, adding %d, limit %d", active, adding, limit)
+		return errRegistrationLimitReached
+	}
+	return nil
+}
+
+// insertRegistrations inserts every request in one transaction; either all
+// rows are created or none are. The per-number cap counts every row the
+// batch adds for a number.
+func (s *server) insertRegistrations(ctx context.Context, reqs []createRegistrationRequest) ([]Registration, error) {
+	start := time.Now()
+	log.Printf("insertRegistrations: running %d INSERT INTO registration in a transaction", len(reqs))
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	adding := map[string]int{}
+	for _, req := range reqs {
+		adding[req.WhatsappNumber]++
+	}
+	// lock in a fixed order so two batches sharing numbers can't deadlock
+	for _, number := range slices.Sorted(maps.Keys(adding)) {
+		if err := s.checkWhatsappLimit(ctx, tx, number, adding[number]); err != nil {
+			return nil, err
+		}
+	}
+
+	registrations := make([]Registration, 0, len(reqs))
+	for _, req := range reqs {
+		r, err := scanRegistration(tx.QueryRow(ctx, insertRegistrationSQL, insertRegistrationArgs(req)...))
+		if err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, r)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	log.Printf("insertRegistrations: inserted %d rows in %s", len(registrations), time.Since(start).String())
+	return registrations, nil
+}
+
+func (s *server) getRegistrationByID(ctx context.Context, id uuid.UUID) (Registration, error) {
+	if r, ok := s.regCache.get(id); ok {
+		log.Printf("getRegistrationByID: cache hit id=%s", id.String())
+		return r, nil
+	}
+
+	start := time.Now()
+	log.Println("getRegistrationByID: running SELECT ... FROM registration WHERE registration_id=$1")
+
+	r, err := retryRead(ctx, "getRegistrationByID", func() (Registration, error) {
+		return scanRegistration(s.readDB().QueryRow(ctx, `
+			SELECT `+registrationColumns+`
+			FROM registration
+			WHERE registration_id = $1
+		`, id))
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Registration{}, errRegistrationNotFound
+		}
+		return Registration{}, err
+	}
+
+	s.regCache.put(r)
+
+	log.Printf("getRegistrationByID: fetched id=%s in %s", r.RegistrationID.String(), time.Since(start).String())
+	return r, nil
+}
+
+const updateRegistrationSQL = `
+	UPDATE registration
+	SET full_name = $2, job_title = $3, address_full = $4, whatsapp_number = $5,
+		note = $6, applicant_count = $7, visa_type = $8, updated_at = now()
+	WHERE registration_id = $1
+	RETURNING ` + registrationColumns
+
+// updateRegistration locks the registration on the primary, hands the current
+// row to apply and writes back the request apply returns, all in one
+// transaction. An error from apply aborts the update and is returned as is,
+// so callers can check preconditions against the row they will overwrite.
+// Moving an active registration to another WhatsApp number counts against
+// that number's cap, as a create would.
+func (s *server) updateRegistration(ctx context.Context, id uuid.UUID, apply func(current Registration) (createRegistrationRequest, error)) (Registration, error) {
+	start := time.Now()
+	log.Println("updateRegistration: running SELECT ... FOR UPDATE and UPDATE registration in a transaction")
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return Registration{}, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	current, err := scanRegistration(tx.QueryRow(ctx, `
+		SELECT `+registrationColumns+`
 		FROM registration
 		WHERE registration_id = $1
-	`, id).Scan(
-		&r.RegistrationID,
-		&r.FullName,
-		&jobTitle,
-		&addressFull,
-		&r.WhatsappNumber,
-		&note,
-		&r.ApplicantCount,
-		&visaType,
-		&r.CreatedAt,
-		&r.UpdatedAt,
-	)
+		FOR UPDATE
+	`, id))
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return Registration{}, errRegistrationNotFound
@@ -216,42 +1040,501 @@ func (s *server) getRegistrationByID(ctx context.Context, id uuid.UUID) (Registr
 		return Registration{}, err
 	}
 
-	if jobTitle.Valid {
-		r.JobTitle = &jobTitle.String
+	req, err := apply(current)
+	if err != nil {
+		return Registration{}, err
 	}
-	if addressFull.Valid {
-		r.AddressFull = &addressFull.String
+	if req.WhatsappNumber != current.WhatsappNumber && !slices.Contains(s.cfg.RegistrationLimitExemptStatuses, current.Status) {
+		if err := s.checkWhatsappLimit(ctx, tx, req.WhatsappNumber, 1); err != nil {
+			return Registration{}, err
+		}
 	}
-	if note.Valid {
-		r.Note = &note.String
+
+	args := append([]any{id}, insertRegistrationArgs(req)...)
+	r, err := scanRegistration(tx.QueryRow(ctx, updateRegistrationSQL, args...))
+	if err != nil {
+		return Registration{}, err
 	}
-	if visaType.Valid {
-		r.VisaType = &visaType.String
+
+	if err := tx.Commit(ctx); err != nil {
+		return Registration{}, err
 	}
+	s.regCache.invalidate(id)
 
-	log.Printf("getRegistrationByID: fetched id=%s in %s", r.RegistrationID.String(), time.Since(start).String())
+	log.Printf("updateRegistration: updated id=%s in %s", id.String(), time.Since(start).String())
 	return r, nil
 }
 
-func (s *server) saveRegistrationFile(ctx context.Context, registrationID uuid.UUID, fileType, filename string, data []byte) (uuid.UUID, error) {
+// statusOutcome is what updateRegistrationStatuses decided for one id.
+type statusOutcome struct {
+	found  bool
+	from   string
+	reason string
+}
+
+// updateRegistrationStatuses locks the given registrations, checks each
+// transition to status and applies the allowed ones in one transaction,
+// recording each change in registration_status_history. Rows that fail the
+// check are left untouched and reported with a reason.
+func (s *server) updateRegistrationStatuses(ctx context.Context, ids []uuid.UUID, status, requestID string) (map[uuid.UUID]statusOutcome, error) {
 	start := time.Now()
-	log.Println("saveRegistrationFile: verifying registration exists")
+	log.Printf("updateRegistrationStatuses: locking %d registrations for status=%s", len(ids), status)
 
-	var exists bool
-	if err := s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM registration WHERE registration_id = $1)`, registrationID).Scan(&exists); err != nil {
+	outcomes := make(map[uuid.UUID]statusOutcome, len(ids))
+	if len(ids) == 0 {
+		return outcomes, nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	rows, err := tx.Query(ctx, `
+		SELECT registration_id, status
+		FROM registration
+		WHERE registration_id = ANY($1)
+		ORDER BY registration_id
+		FOR UPDATE
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	var apply []uuid.UUID
+	for rows.Next() {
+		var (
+			id   uuid.UUID
+			from string
+		)
+		if err := rows.Scan(&id, &from); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		reason := checkStatusTransition(from, status)
+		outcomes[id] = statusOutcome{found: true, from: from, reason: reason}
+		if reason == "" && from != status {
+			apply = append(apply, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(apply) > 0 {
+		if _, err := tx.Exec(ctx, `
+			UPDATE registration
+			SET status = $2, updated_at = now()
+			WHERE registration_id = ANY($1)
+		`, apply, status); err != nil {
+			return nil, err
+		}
+
+		from := make([]string, len(apply))
+		for i, id := range apply {
+			from[i] = outcomes[id].from
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO registration_status_history (registration_id, from_status, to_status, request_id)
+			SELECT id, from_status, $3, NULLIF($4, '')
+			FROM unnest($1::uuid[], $2::text[]) AS t (id, from_status)
+		`, apply, from, status, requestID); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	for _, id := range apply {
+		s.regCache.invalidate(id)
+	}
+
+	log.Printf("updateRegistrationStatuses: updated %d of %d rows in %s", len(apply), len(ids), time.Since(start).String())
+	return outcomes, nil
+}
+
+// StatusTransition is one recorded status change of a registration.
+type StatusTransition struct {
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedAt  time.Time `json:"changed_at"`
+	RequestID  *string   `json:"request_id,omitempty"`
+}
+
+func (s *server) getRegistrationTimeline(ctx context.Context, id uuid.UUID) ([]StatusTransition, error) {
+	return retryRead(ctx, "getRegistrationTimeline", func() ([]StatusTransition, error) {
+		start := time.Now()
+		log.Println("getRegistrationTimeline: running SELECT ... FROM registration_status_history")
+
+		rows, err := s.readDB().Query(ctx, `
+			SELECT from_status, to_status, changed_at, request_id
+			FROM registration_status_history
+			WHERE registration_id = $1
+			ORDER BY changed_at, history_id
+		`, id)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		transitions := []StatusTransition{}
+		for rows.Next() {
+			var (
+				t         StatusTransition
+				requestID sql.NullString
+			)
+			if err := rows.Scan(&t.FromStatus, &t.ToStatus, &t.ChangedAt, &requestID); err != nil {
+				return nil, err
+			}
+			t.ChangedAt = t.ChangedAt.UTC()
+			if requestID.Valid {
+				t.RequestID = &requestID.String
+			}
+			transitions = append(transitions, t)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+
+		log.Printf("getRegistrationTimeline: fetched %d transitions in %s", len(transitions), time.Since(start).String())
+		return transitions, nil
+	})
+}
+
+type listRegistrationsParams struct {
+	Limit  int
+	Offset int
+	// Sort is a key of registrationSortColumns; "" sorts by created_at.
+	Sort   string
+	Desc   bool
+	Cursor *registrationCursor
+	// Archived lists archived registrations instead of active ones.
+	Archived bool
+}
+
+// registrationSortColumn is one allowlisted ?sort= field: the column it
+// orders by, its SQL type for casting cursor values, and how to read the
+// cursor value off a row. Keyset paging compares row values, which NULL
+// breaks, so only NOT NULL columns may be listed here.
+type registrationSortColumn struct {
+	column  string
+	sqlType string
+	value   func(Registration) string
+}
+
+var registrationSortColumns = map[string]registrationSortColumn{
+	"created_at": {"created_at", "timestamptz", func(r Registration) string { return r.CreatedAt.Format(time.RFC3339Nano) }},
+	"full_name":  {"full_name", "text", func(r Registration) string { return r.FullName }},
+	"applicant_count": {"applicant_count", "int", func(r Registration) string {
+		return strconv.Itoa(r.ApplicantCount)
+	}},
+	"status": {"status", "text", func(r Registration) string { return r.Status }},
+}
+
+func (p listRegistrationsParams) sortColumn() registrationSortColumn {
+	if col, ok := registrationSortColumns[p.Sort]; ok {
+		return col
+	}
+	return registrationSortColumns["created_at"]
+}
+
+// listRegistrations returns registrations in the requested order. The
+// registration_id tiebreak keeps the order total, so both offset and cursor
+// paging are stable.
+func (s *server) listRegistrations(ctx context.Context, p listRegistrationsParams) ([]Registration, error) {
+	start := time.Now()
+	col := p.sortColumn()
+	dir, cmp := "ASC", ">"
+	if p.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	orderBy := orderTerm(col.column, dir, false) + ", registration_id " + dir
+	log.Printf("listRegistrations: running SELECT ... FROM registration ORDER BY %s", orderBy)
+
+	var args []any
+	where := `WHERE ` + archivedCondition(p.Archived)
+	if p.Cursor != nil {
+		where += ` AND (` + col.column + `, registration_id) ` + cmp + ` ($1::` + col.sqlType + `, $2)`
+		args = append(args, p.Cursor.Value, p.Cursor.RegistrationID)
+	}
+	args = append(args, s.rowCeilingLimit(p.Limit), p.Offset)
+
+	rows, err := s.readDB().Query(ctx, `
+		SELECT `+registrationColumns+`
+		FROM registration
+		`+where+`
+		ORDER BY `+orderBy+`
+		LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	registrations := make([]Registration, 0)
+	for rows.Next() {
+		r, err := scanRegistration(rows)
+		if err != nil {
+			return nil, err
+		}
+		registrations = append(registrations, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	registrations = truncateToCeiling(s, "listRegistrations", p.Limit, registrations)
+
+	log.Printf("listRegistrations: fetched %d rows in %s", len(registrations), time.Since(start).String())
+	return registrations, nil
+}
+
+// registrationFilter narrows registration queries; zero fields match everything.
+type registrationFilter struct {
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time // exclusive
+}
+
+// where renders the filter as a WHERE clause whose placeholders start after
+// the args already in use.
+func (f registrationFilter) where(args []any) (string, []any) {
+	var conds []string
+	if f.CreatedFrom != nil {
+		args = append(args, *f.CreatedFrom)
+		conds = append(conds, "created_at >= $"+strconv.Itoa(len(args)))
+	}
+	if f.CreatedTo != nil {
+		args = append(args, *f.CreatedTo)
+		conds = append(conds, "created_at < $"+strconv.Itoa(len(args)))
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+// registrationCount is one cell of the visa_type × status cross-tab; VisaType
+// is "" for registrations without one.
+type registrationCount struct {
+	VisaType string
+	Status   string
+	Count    int
+}
+
+func (s *server) countRegistrationsByVisaAndStatus(ctx context.Context, f registrationFilter) ([]registrationCount, error) {
+	start := time.Now()
+	log.Println("countRegistrationsByVisaAndStatus: running SELECT visa_type, status, COUNT(*) FROM registration GROUP BY visa_type, status")
+
+	where, args := f.where(nil)
+	counts, err := retryRead(ctx, "countRegistrationsByVisaAndStatus", func() ([]registrationCount, error) {
+		rows, err := s.readDB().Query(ctx, `
+			SELECT COALESCE(visa_type, ''), status, COUNT(*)
+			FROM registration
+			`+where+`
+			GROUP BY visa_type, status
+			ORDER BY 1, 2
+		`, args...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var counts []registrationCount
+		for rows.Next() {
+			var c registrationCount
+			if err := rows.Scan(&c.VisaType, &c.Status, &c.Count); err != nil {
+				return nil, err
+			}
+			counts = append(counts, c)
+		}
+		return counts, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("countRegistrationsByVisaAndStatus: fetched %d groups in %s", len(counts), time.Since(start).String())
+	return counts, nil
+}
+
+// forEachRegistration streams every matching registration, oldest first, to
+// fn without holding the full result set in memory.
+func (s *server) forEachRegistration(ctx context.Context, f registrationFilter, fn func(Registration) error) error {
+	start := time.Now()
+	log.Println("forEachRegistration: running SELECT ... FROM registration ORDER BY created_at, registration_id")
+
+	where, args := f.where(nil)
+	rows, err := s.readDB().Query(ctx, `
+		SELECT `+registrationColumns+`
+		FROM registration
+		`+where+`
+		ORDER BY created_at, registration_id
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		r, err := scanRegistration(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+		n++
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	log.Printf("forEachRegistration: streamed %d rows in %s", n, time.Since(start).String())
+	return nil
+}
+
+func archivedCondition(archived bool) string {
+	if archived {
+		return "archived_at IS NOT NULL"
+	}
+	return "archived_at IS NULL"
+}
+
+func (s *server) countRegistrations(ctx context.Context, archived bool) (int, error) {
+	var n int
+	err := s.readDB().QueryRow(ctx, `SELECT COUNT(*) FROM registration WHERE `+archivedCondition(archived)).Scan(&n)
+	return n, err
+}
+
+// registrationArchiveBatch bounds how many rows one archival UPDATE touches,
+// keeping its locks and WAL burst small.
+const registrationArchiveBatch = 500
+
+// archiveRegistrations periodically marks registrations older than maxAge
+// that are in a final status as archived, in batches, until ctx is done.
+func (s *server) archiveRegistrations(ctx context.Context, maxAge, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var final []string
+	for _, status := range registrationStatuses {
+		if len(statusTransitions[status]) == 0 {
+			final = append(final, status)
+		}
+	}
+
+	for {
+		cutoff := time.Now().Add(-maxAge)
+		total := int64(0)
+		for ctx.Err() == nil {
+			batchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			ids, err := s.archiveRegistrationBatch(batchCtx, cutoff, final)
+			cancel()
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("archiveRegistrations: batch failed: %v", err)
+				}
+				break
+			}
+			for _, id := range ids {
+				s.regCache.invalidate(id)
+			}
+			total += int64(len(ids))
+			if len(ids) < registrationArchiveBatch {
+				break
+			}
+		}
+		if total > 0 {
+			log.Printf("archiveRegistrations: archived %d registrations created before %s", total, cutoff.UTC().Format(time.RFC3339))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) archiveRegistrationBatch(ctx context.Context, cutoff time.Time, statuses []string) ([]uuid.UUID, error) {
+	rows, err := s.db.Query(ctx, `
+		UPDATE registration
+		SET archived_at = now()
+		WHERE registration_id IN (
+			SELECT registration_id
+			FROM registration
+			WHERE archived_at IS NULL AND created_at < $1 AND status = ANY($2)
+			ORDER BY created_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING registration_id
+	`, cutoff, statuses, registrationArchiveBatch)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uuid.UUID])
+}
+
+func (s *server) saveRegistrationFile(ctx context.Context, registrationID uuid.UUID, fileType, filename, mimeType string, data []byte, size *imageSize) (uuid.UUID, error) {
+	start := time.Now()
+
+	// compress before taking the lock so it is held only for the queries
+	stored, compressed := s.compressForStorage(data, mimeType)
+	width, height := size.columns()
+
+	// the id is chosen up front so a fallback filename can embed it
+	fileID := uuid.New()
+	if strings.TrimSpace(filename) == "" {
+		filename = fallbackFilename(fileType, fileID, mimeType)
+	}
+
+	log.Println("saveRegistrationFile: verifying registration exists in a transaction")
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
 		return uuid.Nil, err
 	}
-	if !exists {
-		return uuid.Nil, errRegistrationNotFound
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// With a quota the registration row is locked so concurrent uploads to
+	// the same registration queue up behind each other: each one sums usage
+	// only after the previous insert has committed, and the quota holds.
+	lock := ""
+	if s.cfg.RegistrationStorageQuota > 0 {
+		lock = " FOR UPDATE"
+	}
+	var found int
+	if err := tx.QueryRow(ctx, `SELECT 1 FROM registration WHERE registration_id = $1`+lock, registrationID).Scan(&found); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uuid.Nil, errRegistrationNotFound
+		}
+		return uuid.Nil, err
+	}
+
+	if s.cfg.RegistrationStorageQuota > 0 {
+		var usage int64
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(file_size), 0) FROM file_upload WHERE registration_id = $1 AND deleted_at IS NULL`, registrationID).Scan(&usage); err != nil {
+			return uuid.Nil, err
+		}
+		if usage+int64(len(data)) > s.cfg.RegistrationStorageQuota {
+			return uuid.Nil, &storageQuotaError{Usage: usage, Limit: s.cfg.RegistrationStorageQuota}
+		}
 	}
 
-	var fileID uuid.UUID
 	log.Println("saveRegistrationFile: inserting into file_upload")
-	if err := s.db.QueryRow(ctx, `
-		INSERT INTO file_upload (registration_id, file_type, filename, file, file_size)
-		VALUES ($1, $2, $3, $4, $5)
-		RETURNING file_id
-	`, registrationID, fileType, filename, data, int64(len(data))).Scan(&fileID); err != nil {
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO file_upload (file_id, registration_id, file_type, filename, file, file_size, mime_type, compressed, width, height, content_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, fileID, registrationID, fileType, filename, stored, int64(len(data)), mimeType, compressed, width, height, contentHash(data)); err != nil {
+		return uuid.Nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
 		return uuid.Nil, err
 	}
 
@@ -260,22 +1543,43 @@ func (s *server) saveRegistrationFile(ctx context.Context, registrationID uuid.U
 }
 
 type RegistrationFile struct {
-	FileID         uuid.UUID
-	RegistrationID uuid.UUID
-	FileType       string
-	Filename       string
-	FileSize       int64
-	Data           []byte
-	CreatedAt      time.Time
+	FileID         uuid.UUID  `json:"file_id"`
+	RegistrationID uuid.UUID  `json:"registration_id"`
+	FileType       string     `json:"file_type"`
+	Filename       string     `json:"filename"`
+	MimeType       *string    `json:"mime_type,omitempty"`
+	FileSize       int64      `json:"file_size"`
+	DownloadCount  int64      `json:"download_count"`
+	ContentHash    *string    `json:"content_hash,omitempty"`
+	Width          *int       `json:"width,omitempty"`
+	Height         *int       `json:"height,omitempty"`
+	Data           []byte     `json:"-"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+	// RetentionUntil is when the file's file_type retention policy deletes
+	// it; nil for types kept indefinitely.
+	RetentionUntil *time.Time `json:"retention_until,omitempty"`
 }
 
 func (s *server) getRegistrationFile(ctx context.Context, fileID uuid.UUID) (RegistrationFile, error) {
+	return retryRead(ctx, "getRegistrationFile", func() (RegistrationFile, error) { return s.getRegistrationFileOnce(ctx, fileID) })
+}
+
+func (s *server) getRegistrationFileOnce(ctx context.Context, fileID uuid.UUID) (RegistrationFile, error) {
 	start := time.Now()
 	log.Println("getRegistrationFile: running SELECT ... FROM file_upload WHERE file_id=$1")
 
-	var rf RegistrationFile
-	err := s.db.QueryRow(ctx, `
-		SELECT file_id, registration_id, file_type, filename, file_size, file, created_at
+	var (
+		rf         RegistrationFile
+		mimeType   sql.NullString
+		hash       sql.NullString
+		compressed bool
+		deleted    bool
+	)
+	err := s.readDB().QueryRow(ctx, `
+		SELECT file_id, registration_id, file_type, filename, mime_type, file_size, download_count, content_hash,
+		       CASE WHEN deleted_at IS NULL THEN file END, compressed, created_at, updated_at, deleted_at IS NOT NULL
 		FROM file_upload
 		WHERE file_id = $1
 	`, fileID).Scan(
@@ -283,9 +1587,15 @@ func (s *server) getRegistrationFile(ctx context.Context, fileID uuid.UUID) (Reg
 		&rf.RegistrationID,
 		&rf.FileType,
 		&rf.Filename,
+		&mimeType,
 		&rf.FileSize,
+		&rf.DownloadCount,
+		&hash,
 		&rf.Data,
+		&compressed,
 		&rf.CreatedAt,
+		&rf.UpdatedAt,
+		&deleted,
 	)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -293,7 +1603,521 @@ func (s *server) getRegistrationFile(ctx context.Context, fileID uuid.UUID) (Reg
 		}
 		return RegistrationFile{}, err
 	}
+	if deleted {
+		return RegistrationFile{}, errFileDeleted
+	}
+
+	if mimeType.Valid {
+		rf.MimeType = &mimeType.String
+	}
+	if hash.Valid {
+		rf.ContentHash = &hash.String
+	}
+	rf.CreatedAt = rf.CreatedAt.UTC()
+	rf.UpdatedAt = rf.UpdatedAt.UTC()
+	rf.RetentionUntil = s.retentionUntil(rf.FileType, rf.CreatedAt)
+
+	if compressed && len(rf.Data) > 0 {
+		if rf.Data, err = decompress(rf.Data); err != nil {
+			return RegistrationFile{}, err
+		}
+	}
 
 	log.Printf("getRegistrationFile: fetched file_id=%s in %s", rf.FileID.String(), time.Since(start).String())
 	return rf, nil
 }
+
+// updateRegistrationFile swaps the stored bytes of an existing file while
+// keeping its file_id and file_type, which it returns. The registration's
+// storage quota is checked with the old file's size swapped for the new one.
+func (s *server) updateRegistrationFile(ctx context.Context, fileID uuid.UUID, filename string, data []byte) (string, error) {
+	start := time.Now()
+	log.Println("updateRegistrationFile: running UPDATE file_upload WHERE file_id=$1")
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// With a quota the registration row is locked first, as saveRegistrationFile
+	// does, so replacements and new uploads for one registration queue up
+	// behind each other and each sees the other's committed size.
+	var registrationID uuid.UUID
+	if s.cfg.RegistrationStorageQuota > 0 {
+		if err := tx.QueryRow(ctx, `SELECT registration_id FROM file_upload WHERE file_id = $1`, fileID).Scan(&registrationID); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return "", errFileNotFound
+			}
+			return "", err
+		}
+		if _, err := tx.Exec(ctx, `SELECT 1 FROM registration WHERE registration_id = $1 FOR UPDATE`, registrationID); err != nil {
+			return "", err
+		}
+	}
+
+	var (
+		fileType string
+		deleted  bool
+		oldSize  int64
+	)
+	if err := tx.QueryRow(ctx, `SELECT file_type, deleted_at IS NOT NULL, COALESCE(file_size, 0) FROM file_upload WHERE file_id = $1 FOR UPDATE`, fileID).Scan(&fileType, &deleted, &oldSize); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errFileNotFound
+		}
+		return "", err
+	}
+	if deleted {
+		return "", errFileDeleted
+	}
+
+	if s.cfg.RegistrationStorageQuota > 0 {
+		var usage int64
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(SUM(file_size), 0) FROM file_upload WHERE registration_id = $1 AND deleted_at IS NULL`, registrationID).Scan(&usage); err != nil {
+			return "", err
+		}
+		if usage-oldSize+int64(len(data)) > s.cfg.RegistrationStorageQuota {
+			return "", &storageQuotaError{Usage: usage, Limit: s.cfg.RegistrationStorageQuota}
+		}
+	}
+
+	detected := sniffMimeType(data)
+	if err := s.checkFileTypeMime(fileType, detected); err != nil {
+		return "", err
+	}
+	mimeType := storedMimeType(fileType, detected)
+	size, err := s.checkImageUpload(fileType, mimeType, data)
+	if err != nil {
+		return "", err
+	}
+	width, height := size.columns()
+	if strings.TrimSpace(filename) == "" {
+		filename = fallbackFilename(fileType, fileID, mimeType)
+	}
+
+	stored, compressed := s.compressForStorage(data, mimeType)
+	if _, err := tx.Exec(ctx, `
+		UPDATE file_upload
+		SET file = $2, filename = $3, file_size = $4, mime_type = $5, compressed = $6, width = $7, height = $8,
+			content_hash = $9, updated_at = now()
+		WHERE file_id = $1
+	`, fileID, stored, filename, int64(len(data)), mimeType, compressed, width, height, contentHash(data)); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	log.Printf("updateRegistrationFile: replaced file_id=%s in %s", fileID.String(), time.Since(start).String())
+	return fileType, nil
+}
+
+// softDeleteRegistrationFile hides a file from listings and downloads while
+// keeping the row for auditing.
+func (s *server) softDeleteRegistrationFile(ctx context.Context, fileID uuid.UUID) error {
+	start := time.Now()
+	log.Println("softDeleteRegistrationFile: running UPDATE file_upload SET deleted_at WHERE file_id=$1")
+
+	tag, err := s.db.Exec(ctx, `UPDATE file_upload SET deleted_at = now() WHERE file_id = $1 AND deleted_at IS NULL`, fileID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		var exists bool
+		if err := s.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM file_upload WHERE file_id = $1)`, fileID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return errFileDeleted
+		}
+		return errFileNotFound
+	}
+
+	log.Printf("softDeleteRegistrationFile: deleted file_id=%s in %s", fileID.String(), time.Since(start).String())
+	return nil
+}
+
+// listRegistrationFiles returns file metadata for a registration, without the
+// file bytes. Soft-deleted files are only included when includeDeleted is set.
+func (s *server) listRegistrationFiles(ctx context.Context, registrationID uuid.UUID, includeDeleted bool) ([]RegistrationFile, error) {
+	start := time.Now()
+	log.Println("listRegistrationFiles: running SELECT ... FROM file_upload WHERE registration_id=$1")
+
+	var exists bool
+	if err := s.readDB().QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM registration WHERE registration_id = $1)`, registrationID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errRegistrationNotFound
+	}
+
+	rows, err := s.readDB().Query(ctx, `
+		SELECT file_id, registration_id, file_type, filename, mime_type, file_size, download_count, content_hash, width, height, created_at, updated_at, deleted_at
+		FROM file_upload
+		WHERE registration_id = $1 AND ($2 OR deleted_at IS NULL)
+		ORDER BY created_at, file_id
+	`, registrationID, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]RegistrationFile, 0)
+	for rows.Next() {
+		var (
+			rf            RegistrationFile
+			mimeType      sql.NullString
+			hash          sql.NullString
+			width, height sql.NullInt32
+			deletedAt     sql.NullTime
+		)
+		if err := rows.Scan(
+			&rf.FileID,
+			&rf.RegistrationID,
+			&rf.FileType,
+			&rf.Filename,
+			&mimeType,
+			&rf.FileSize,
+			&rf.DownloadCount,
+			&hash,
+			&width,
+			&height,
+			&rf.CreatedAt,
+			&rf.UpdatedAt,
+			&deletedAt,
+		); err != nil {
+			return nil, err
+		}
+		if deletedAt.Valid {
+			t := deletedAt.Time.UTC()
+			rf.DeletedAt = &t
+		}
+		if mimeType.Valid {
+			rf.MimeType = &mimeType.String
+		}
+		if hash.Valid {
+			rf.ContentHash = &hash.String
+		}
+		if width.Valid && height.Valid {
+			w, h := int(width.Int32), int(height.Int32)
+			rf.Width, rf.Height = &w, &h
+		}
+		rf.CreatedAt = rf.CreatedAt.UTC()
+		rf.UpdatedAt = rf.UpdatedAt.UTC()
+		rf.RetentionUntil = s.retentionUntil(rf.FileType, rf.CreatedAt)
+		files = append(files, rf)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("listRegistrationFiles: fetched %d rows for registration=%s in %s", len(files), registrationID.String(), time.Since(start).String())
+	return files, nil
+}
+
+// incrementDownloadCount counts one download of a file, in its running
+// download_count and in today's (UTC) row of file_download_daily, in one
+// statement so the two never disagree.
+func (s *server) incrementDownloadCount(ctx context.Context, fileID uuid.UUID) error {
+	_, err := s.db.Exec(ctx, `
+		WITH counted AS (
+			UPDATE file_upload SET download_count = download_count + 1 WHERE file_id = $1
+			RETURNING file_id
+		)
+		INSERT INTO file_download_daily (file_id, day, downloads)
+		SELECT file_id, (now() AT TIME ZONE 'UTC')::date, 1 FROM counted
+		ON CONFLICT (file_id, day) DO UPDATE SET downloads = file_download_daily.downloads + 1
+	`, fileID)
+	return err
+}
+
+// fileDownloadDay is one UTC day's download count for a file.
+type fileDownloadDay struct {
+	Day       string `json:"day"`
+	Downloads int64  `json:"downloads"`
+}
+
+// fileDownloads is a file's download_count and its per-day breakdown.
+type fileDownloads struct {
+	FileID        uuid.UUID         `json:"file_id"`
+	DownloadCount int64             `json:"download_count"`
+	Days          int               `json:"days"`
+	ByDay         []fileDownloadDay `json:"by_day"`
+}
+
+// getFileDownloads returns a file's download counts for the last days UTC
+// days, today included and newest first. Days without downloads are left out.
+func (s *server) getFileDownloads(ctx context.Context, fileID uuid.UUID, days int) (fileDownloads, error) {
+	start := time.Now()
+	log.Println("getFileDownloads: running SELECT download_count, file_download_daily WHERE file_id=$1")
+
+	fd := fileDownloads{FileID: fileID, Days: days, ByDay: make([]fileDownloadDay, 0)}
+	if err := s.readDB().QueryRow(ctx, `SELECT download_count FROM file_upload WHERE file_id = $1 AND deleted_at IS NULL`, fileID).Scan(&fd.DownloadCount); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fileDownloads{}, errFileNotFound
+		}
+		return fileDownloads{}, err
+	}
+
+	rows, err := s.readDB().Query(ctx, `
+		SELECT to_char(day, 'YYYY-MM-DD'), downloads
+		FROM file_download_daily
+		WHERE file_id = $1 AND day > (now() AT TIME ZONE 'UTC')::date - $2::int
+		ORDER BY day DESC
+	`, fileID, days)
+	if err != nil {
+		return fileDownloads{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d fileDownloadDay
+		if err := rows.Scan(&d.Day, &d.Downloads); err != nil {
+			return fileDownloads{}, err
+		}
+		fd.ByDay = append(fd.ByDay, d)
+	}
+	if err := rows.Err(); err != nil {
+		return fileDownloads{}, err
+	}
+
+	log.Printf("getFileDownloads: fetched %d days for file_id=%s in %s", len(fd.ByDay), fileID.String(), time.Since(start).String())
+	return fd, nil
+}
+
+// Upload session targets: where a finished resumable upload is stored.
+const (
+	uploadTargetRegistrationFile = "registration_file"
+	uploadTargetCV               = "cv"
+)
+
+// uploadSession is a resumable upload in progress. The assembled bytes stay
+// in the table and are only read back when the upload is finalized.
+type uploadSession struct {
+	UploadID       uuid.UUID  `json:"upload_id"`
+	Target         string     `json:"target"`
+	RegistrationID *uuid.UUID `json:"registration_id,omitempty"`
+	UserID         *int64     `json:"user_id,omitempty"`
+	FileType       *string    `json:"file_type,omitempty"`
+	Filename       string     `json:"filename"`
+	Length         int64      `json:"length"`
+	Offset         int64      `json:"offset"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+func (s *server) createUploadSession(ctx context.Context, u uploadSession) (uploadSession, error) {
+	start := time.Now()
+	log.Println("createUploadSession: running INSERT INTO upload_session")
+
+	u.UploadID = uuid.New()
+	err := s.db.QueryRow(ctx, `
+		INSERT INTO upload_session (upload_id, target, registration_id, user_id, file_type, filename, upload_length)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING created_at, updated_at
+	`, u.UploadID, u.Target, u.RegistrationID, u.UserID, u.FileType, u.Filename, u.Length).Scan(&u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		return uploadSession{}, err
+	}
+	u.CreatedAt = u.CreatedAt.UTC()
+	u.UpdatedAt = u.UpdatedAt.UTC()
+
+	log.Printf("createUploadSession: created upload_id=%s target=%s length=%d in %s", u.UploadID.String(), u.Target, u.Length, time.Since(start).String())
+	return u, nil
+}
+
+// getUploadSession reads a session from the primary, since its offset moves
+// with every chunk. Sessions idle since before cutoff count as gone.
+func (s *server) getUploadSession(ctx context.Context, uploadID uuid.UUID, cutoff time.Time) (uploadSession, error) {
+	start := time.Now()
+	log.Println("getUploadSession: running SELECT ... FROM upload_session WHERE upload_id=$1")
+
+	var (
+		u              uploadSession
+		registrationID *uuid.UUID
+		userID         sql.NullInt64
+		fileType       sql.NullString
+	)
+	err := s.db.QueryRow(ctx, `
+		SELECT upload_id, target, registration_id, user_id, file_type, filename, upload_length, upload_offset, created_at, updated_at
+		FROM upload_session
+		WHERE upload_id = $1 AND updated_at > $2
+	`, uploadID, cutoff).Scan(&u.UploadID, &u.Target, &registrationID, &userID, &fileType, &u.Filename, &u.Length, &u.Offset, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return uploadSession{}, errUploadNotFound
+		}
+		return uploadSession{}, err
+	}
+
+	u.RegistrationID = registrationID
+	if userID.Valid {
+		u.UserID = &userID.Int64
+	}
+	if fileType.Valid {
+		u.FileType = &fileType.String
+	}
+	u.CreatedAt = u.CreatedAt.UTC()
+	u.UpdatedAt = u.UpdatedAt.UTC()
+
+	log.Printf("getUploadSession: fetched upload_id=%s in %s", uploadID.String(), time.Since(start).String())
+	return u, nil
+}
+
+// appendUploadChunk appends chunk at offset and returns the new offset. The
+// update only matches while the stored offset still equals offset, so two
+// clients racing on one session can't interleave bytes.
+func (s *server) appendUploadChunk(ctx context.Context, uploadID uuid.UUID, offset int64, chunk []byte) (int64, error) {
+	start := time.Now()
+	log.Println("appendUploadChunk: running UPDATE upload_session SET data = data || $3")
+
+	var newOffset int64
+	err := s.db.QueryRow(ctx, `
+		UPDATE upload_session
+		SET data = data || $3, upload_offset = upload_offset + $4, updated_at = now()
+		WHERE upload_id = $1 AND upload_offset = $2 AND upload_offset + $4 <= upload_length
+		RETURNING upload_offset
+	`, uploadID, offset, chunk, int64(len(chunk))).Scan(&newOffset)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, errUploadOffsetMismatch
+		}
+		return 0, err
+	}
+
+	log.Printf("appendUploadChunk: upload_id=%s offset=%d in %s", uploadID.String(), newOffset, time.Since(start).String())
+	return newOffset, nil
+}
+
+// claimUploadSession marks a complete session as being finalized and returns
+// its bytes. The update only matches a session nobody has claimed, so of two
+// concurrent finalize requests exactly one gets the data; the other, or any
+// request for a session that is gone, gets errUploadClaimed.
+func (s *server) claimUploadSession(ctx context.Context, uploadID uuid.UUID) ([]byte, error) {
+	start := time.Now()
+	log.Println("claimUploadSession: running UPDATE upload_session SET finalizing = true WHERE upload_id=$1 AND NOT finalizing")
+
+	var data []byte
+	if err := s.db.QueryRow(ctx, `
+		UPDATE upload_session
+		SET finalizing = true, updated_at = now()
+		WHERE upload_id = $1 AND NOT finalizing AND upload_offset = upload_length
+		RETURNING data
+	`, uploadID).Scan(&data); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errUploadClaimed
+		}
+		return nil, err
+	}
+
+	log.Printf("claimUploadSession: claimed %d bytes for upload_id=%s in %s", len(data), uploadID.String(), time.Since(start).String())
+	return data, nil
+}
+
+// releaseUploadSession gives up a claim whose upload was rejected, so the
+// client can finalize again once it has fixed what was wrong.
+func (s *server) releaseUploadSession(ctx context.Context, uploadID uuid.UUID) error {
+	_, err := s.db.Exec(ctx, `UPDATE upload_session SET finalizing = false WHERE upload_id = $1`, uploadID)
+	return err
+}
+
+func (s *server) deleteUploadSession(ctx context.Context, uploadID uuid.UUID) error {
+	log.Println("deleteUploadSession: running DELETE FROM upload_session WHERE upload_id=$1")
+
+	tag, err := s.db.Exec(ctx, `DELETE FROM upload_session WHERE upload_id = $1`, uploadID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errUploadNotFound
+	}
+	return nil
+}
+
+// expireUploadSessions periodically deletes sessions idle for longer than
+// ttl, reclaiming the bytes of uploads that were abandoned part way.
+func (s *server) expireUploadSessions(ctx context.Context, ttl, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		delCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		tag, err := s.db.Exec(delCtx, `DELETE FROM upload_session WHERE updated_at < $1`, time.Now().Add(-ttl))
+		cancel()
+		if err != nil {
+			log.Printf("expireUploadSessions: delete failed: %v", err)
+		} else if n := tag.RowsAffected(); n > 0 {
+			log.Printf("expireUploadSessions: removed %d stale sessions", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) loadFeatureFlags(ctx context.Context) ([]FeatureFlag, error) {
+	return retryRead(ctx, "loadFeatureFlags", func() ([]FeatureFlag, error) {
+		rows, err := s.db.Query(ctx, `SELECT name, enabled, updated_at FROM feature_flags`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		var flags []FeatureFlag
+		for rows.Next() {
+			var (
+				flag      FeatureFlag
+				updatedAt time.Time
+			)
+			if err := rows.Scan(&flag.Name, &flag.Enabled, &updatedAt); err != nil {
+				return nil, err
+			}
+			updatedAt = updatedAt.UTC()
+			flag.UpdatedAt = &updatedAt
+			flags = append(flags, flag)
+		}
+		return flags, rows.Err()
+	})
+}
+
+func (s *server) setFeatureFlag(ctx context.Context, name string, enabled bool) (FeatureFlag, error) {
+	log.Printf("setFeatureFlag: upserting %s", name)
+
+	flag := FeatureFlag{Name: name}
+	var updatedAt time.Time
+	if err := s.db.QueryRow(ctx, `
+		INSERT INTO feature_flags (name, enabled) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = now()
+		RETURNING enabled, updated_at
+	`, name, enabled).Scan(&flag.Enabled, &updatedAt); err != nil {
+		return FeatureFlag{}, err
+	}
+	updatedAt = updatedAt.UTC()
+	flag.UpdatedAt = &updatedAt
+	return flag, nil
+}
+
+// expireRegistrationFiles soft-deletes up to limit live files of fileType
+// created before cutoff and blanks their stored bytes.
+func (s *server) expireRegistrationFiles(ctx context.Context, fileType string, cutoff time.Time, limit int) (int64, error) {
+	tag, err := s.db.Exec(ctx, `
+		UPDATE file_upload
+		SET deleted_at = now(), file = ''::bytea, compressed = false
+		WHERE file_id IN (
+			SELECT file_id
+			FROM file_upload
+			WHERE file_type = $1 AND created_at < $2 AND deleted_at IS NULL
+			ORDER BY created_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+	`, fileType, cutoff, limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testServer connects to the database in TEST_DATABASE_URL and migrates it.
+// Tests that need Postgres are skipped when it isn't set.
+func testServer(t *testing.T) *server {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	if err := runMigrations(ctx, pool); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return &server{db: pool, cfg: loadConfig(), flags: newFeatureFlags()}
+}
+
+// testRegistration creates a registration under a random WhatsApp number, so
+// tests don't trip each other's per-number cap.
+func testRegistration(t *testing.T, s *server) Registration {
+	t.Helper()
+	r, err := s.insertRegistration(context.Background(), createRegistrationRequest{
+		FullName:       "Test Applicant",
+		WhatsappNumber: fmt.Sprintf("+62812%08d", rand.IntN(100_000_000)),
+	})
+	if err != nil {
+		t.Fatalf("insert registration: %v", err)
+	}
+	return r
+}
+
+func TestSaveRegistrationFileConcurrentQuota(t *testing.T) {
+	s := testServer(t)
+	s.cfg.RegistrationStorageQuota = 10 << 10
+	reg := testRegistration(t, s)
+
+	const uploads = 8
+	data := make([]byte, 3<<10) // three fit under the quota, the fourth doesn't
+
+	var (
+		wg               sync.WaitGroup
+		mu               sync.Mutex
+		saved, overQuota int
+	)
+	for range uploads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.saveRegistrationFile(context.Background(), reg.RegistrationID, "other", "blob.bin", "application/octet-stream", data, nil)
+			mu.Lock()
+			defer mu.Unlock()
+			var quotaErr *storageQuotaError
+			switch {
+			case err == nil:
+				saved++
+			case errors.As(err, &quotaErr):
+				overQuota++
+			default:
+				t.Errorf("save: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if saved != 3 || overQuota != uploads-3 {
+		t.Errorf("saved %d, over quota %d; want 3 and %d", saved, overQuota, uploads-3)
+	}
+
+	var usage int64
+	if err := s.db.QueryRow(context.Background(), `
+		SELECT COALESCE(SUM(file_size), 0) FROM file_upload WHERE registration_id = $1 AND deleted_at IS NULL
+	`, reg.RegistrationID).Scan(&usage); err != nil {
+		t.Fatalf("sum usage: %v", err)
+	}
+	if usage > s.cfg.RegistrationStorageQuota {
+		t.Errorf("usage %d exceeds quota %d", usage, s.cfg.RegistrationStorageQuota)
+	}
+}
+
+// The quota check only holds if usage is summed, and the file inserted,
+// under the registration row lock. fakePG fails any statement that isn't.
+func TestStorageQuotaSummedUnderRowLock(t *testing.T) {
+	const size = 3 << 10
+	regID := uuid.New()
+	lock := "registration:" + regID.String()
+
+	var (
+		mu    sync.Mutex
+		usage int64
+	)
+	s := &server{cfg: loadConfig(), flags: newFeatureFlags()}
+	s.cfg.RegistrationStorageQuota = 10 << 10
+	s.db = newFakePG(t, func(sess *fakeSession, query string) fakeResult {
+		switch {
+		case strings.HasPrefix(query, "SELECT 1 FROM registration"):
+			if strings.HasSuffix(query, "FOR UPDATE") {
+				sess.lockRow(lock)
+			}
+			return oneRow(int4Value(1))
+		case strings.Contains(query, "SUM(file_size)"):
+			if !sess.holds(lock) {
+				return failed("usage summed without the registration row lock")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return oneRow(int8Value(usage))
+		case strings.Contains(query, "INSERT INTO file_upload"):
+			if !sess.holds(lock) {
+				return failed("file inserted without the registration row lock")
+			}
+			sess.afterCommit(func() {
+				mu.Lock()
+				usage += size
+				mu.Unlock()
+			})
+			return command("INSERT 0 1")
+		}
+		return failed("unexpected query: " + query)
+	})
+
+	const uploads = 8
+	var (
+		wg               sync.WaitGroup
+		saved, overQuota int
+	)
+	for range uploads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.saveRegistrationFile(context.Background(), regID, "other", "blob.bin", "application/octet-stream", make([]byte, size), nil)
+			mu.Lock()
+			defer mu.Unlock()
+			var quotaErr *storageQuotaError
+			switch {
+			case err == nil:
+				saved++
+			case errors.As(err, &quotaErr):
+				overQuota++
+			default:
+				t.Errorf("save: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if saved != 3 || overQuota != uploads-3 {
+		t.Errorf("saved %d, over quota %d; want 3 and %d", saved, overQuota, uploads-3)
+	}
+	if usage > s.cfg.RegistrationStorageQuota {
+		t.Errorf("usage %d exceeds quota %d", usage, s.cfg.RegistrationStorageQuota)
+	}
+}
+
+func TestOrderTermNulls(t *testing.T) {
+	tests := []struct {
+		column, dir string
+		nullable    bool
+		want        string
+	}{
+		{"name", "ASC", true, "name ASC NULLS LAST"},
+		{"name", "DESC", true, "name DESC NULLS LAST"},
+		{"created_at", "DESC", false, "created_at DESC"},
+	}
+	for _, tt := range tests {
+		if got := orderTerm(tt.column, tt.dir, tt.nullable); got != tt.want {
+			t.Errorf("orderTerm(%q, %q, %t) = %q, want %q", tt.column, tt.dir, tt.nullable, got, tt.want)
+		}
+	}
+
+	if got, want := (listUsersParams{Sort: "name", Desc: true}).orderBy(), "name DESC NULLS LAST, id DESC"; got != want {
+		t.Errorf("users orderBy = %q, want %q", got, want)
+	}
+}
+
+func TestFetchUsersSortsNullNamesLast(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	prefix := fmt.Sprintf("sort-%d-", rand.IntN(1_000_000))
+	names := []*string{nil, ptr(prefix + "b"), nil, ptr(prefix + "a"), ptr(prefix + "c")}
+	ids := map[int64]bool{}
+	for _, name := range names {
+		u, err := s.insertUser(ctx, createUserRequest{Name: name})
+		if err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+		ids[u.ID] = true
+	}
+
+	for _, desc := range []bool{false, true} {
+		users, err := s.fetchUsers(ctx, listUsersParams{Sort: "name", Desc: desc})
+		if err != nil {
+			t.Fatalf("fetch users: %v", err)
+		}
+		var got []string
+		for _, u := range users {
+			if !ids[u.ID] {
+				continue
+			}
+			if u.Name == nil {
+				got = append(got, "<null>")
+			} else {
+				got = append(got, (*u.Name)[len(prefix):])
+			}
+		}
+		want := []string{"a", "b", "c", "<null>", "<null>"}
+		if desc {
+			want = []string{"c", "b", "a", "<null>", "<null>"}
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("desc=%t: order %v, want %v", desc, got, want)
+		}
+	}
+}
+
+func TestStreamUsersStopsAtRowCeiling(t *testing.T) {
+	s := testServer(t)
+	s.cfg.MaxResultRows = 2
+	ctx := context.Background()
+
+	for range 3 {
+		if _, err := s.insertUser(ctx, createUserRequest{}); err != nil {
+			t.Fatalf("insert user: %v", err)
+		}
+	}
+
+	// the NDJSON path streams with no limit at all
+	streamed := 0
+	if err := s.streamUsers(ctx, listUsersParams{}, func(User) error {
+		streamed++
+		return nil
+	}); err != nil {
+		t.Fatalf("stream users: %v", err)
+	}
+	if streamed != s.cfg.MaxResultRows {
+		t.Errorf("streamed %d users, want the ceiling %d", streamed, s.cfg.MaxResultRows)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestRegistrationCursorPagingSurvivesInserts(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	ours := map[string]bool{}
+	for range 5 {
+		ours[testRegistration(t, s).RegistrationID.String()] = true
+	}
+
+	params := listRegistrationsParams{Sort: "created_at", Desc: true, Limit: 2}
+	seen := map[string]int{}
+	var inserted string
+	for page := range 3 {
+		regs, err := s.listRegistrations(ctx, params)
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		for _, r := range regs {
+			seen[r.RegistrationID.String()]++
+		}
+		if len(regs) < params.Limit {
+			break
+		}
+		last := regs[len(regs)-1]
+		params.Cursor = &registrationCursor{
+			Sort:           params.Sort,
+			Desc:           params.Desc,
+			Value:          params.sortColumn().value(last),
+			RegistrationID: last.RegistrationID,
+		}
+
+		// a new registration lands between page fetches
+		if page == 0 {
+			inserted = testRegistration(t, s).RegistrationID.String()
+		}
+	}
+
+	for id, n := range seen {
+		if n > 1 {
+			t.Errorf("registration %s appeared on %d pages", id, n)
+		}
+	}
+	for id := range ours {
+		if seen[id] == 0 {
+			t.Errorf("registration %s was skipped", id)
+		}
+	}
+	if seen[inserted] > 0 {
+		t.Errorf("registration inserted mid-paging showed up on a later page")
+	}
+}
+
+// fakeRow scans fixed values into the destinations, in order.
+type fakeRow []any
+
+func (r fakeRow) Scan(dest ...any) error {
+	if len(dest) != len(r) {
+		return fmt.Errorf("scan: %d destinations for %d values", len(dest), len(r))
+	}
+	for i, v := range r {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+func TestScannedTimestampsSerializeAsUTC(t *testing.T) {
+	jakarta := time.FixedZone("WIB", 7*60*60)
+	local := time.Date(2024, 5, 1, 10, 4, 5, 0, jakarta)
+	const want = `"2024-05-01T03:04:05Z"`
+
+	u, err := scanUser(fakeRow{int64(1), sql.NullString{}, sql.NullInt32{}, local, true, sql.NullInt32{}, sql.NullTime{Time: local, Valid: true}})
+	if err != nil {
+		t.Fatalf("scan user: %v", err)
+	}
+	r, err := scanRegistration(fakeRow{
+		uuid.New(), "Name", sql.NullString{}, sql.NullString{}, "+62812", sql.NullString{}, 1, sql.NullString{}, "new",
+		local, local, sql.NullTime{Time: local, Valid: true},
+	})
+	if err != nil {
+		t.Fatalf("scan registration: %v", err)
+	}
+
+	for name, v := range map[string]any{"user": u, "registration": r} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("marshal %s: %v", name, err)
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(b, &fields); err != nil {
+			t.Fatalf("unmarshal %s: %v", name, err)
+		}
+		checked := 0
+		for key, raw := range fields {
+			if !strings.HasSuffix(key, "_at") {
+				continue
+			}
+			checked++
+			if string(raw) != want {
+				t.Errorf("%s %s = %s, want %s", name, key, raw, want)
+			}
+		}
+		if checked < 2 {
+			t.Errorf("%s: only %d timestamp fields serialized", name, checked)
+		}
+	}
+}
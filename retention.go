@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// retentionUntil is when a file of fileType created at createdAt falls due
+// for deletion, or nil when its type is kept forever.
+func (s *server) retentionUntil(fileType string, createdAt time.Time) *time.Time {
+	period, ok := s.cfg.FileRetention[strings.ToLower(fileType)]
+	if !ok || period <= 0 {
+		return nil
+	}
+	until := createdAt.Add(period).UTC()
+	return &until
+}
+
+// fileRetentionBatch bounds how many files one sweep UPDATE touches.
+const fileRetentionBatch = 200
+
+// sweepExpiredFiles periodically soft-deletes files past their file_type's
+// retention period and erases their bytes, keeping the metadata row as a
+// record of what was held. It runs until ctx is done.
+func (s *server) sweepExpiredFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for fileType, period := range s.cfg.FileRetention {
+			if period <= 0 {
+				continue
+			}
+			cutoff := time.Now().Add(-period)
+			total := int64(0)
+			for ctx.Err() == nil {
+				batchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				n, err := s.expireRegistrationFiles(batchCtx, fileType, cutoff, fileRetentionBatch)
+				cancel()
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("sweepExpiredFiles: file_type=%s batch failed: %v", fileType, err)
+					}
+					break
+				}
+				total += n
+				if n < fileRetentionBatch {
+					break
+				}
+			}
+			if total > 0 {
+				log.Printf("sweepExpiredFiles: deleted %d files of file_type=%s created before %s", total, fileType, cutoff.UTC().Format(time.RFC3339))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// uploadTracker counts upload handlers in flight so shutdown can wait for
+// them instead of cutting files off mid-write.
+type uploadTracker struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	inFlight int
+	closed   bool
+}
+
+// begin registers an upload; it reports false once shutdown has started.
+func (t *uploadTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.inFlight++
+	t.wg.Add(1)
+	return true
+}
+
+func (t *uploadTracker) end() {
+	t.mu.Lock()
+	t.inFlight--
+	t.mu.Unlock()
+	t.wg.Done()
+}
+
+// close stops new uploads and returns how many are still running.
+func (t *uploadTracker) close() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	return t.inFlight
+}
+
+func (t *uploadTracker) running() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inFlight
+}
+
+// shutdown stops accepting uploads, waits up to timeout for those in flight,
+// then shuts the HTTP server down within what is left of the same budget.
+func (s *server) shutdown(httpServer *http.Server, timeout time.Duration) {
+	start := time.Now()
+	pending := s.uploads.close()
+	log.Printf("shutdown: draining %d in-flight uploads (timeout %s)", pending, timeout)
+
+	done := make(chan struct{})
+	go func() {
+		s.uploads.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("shutdown: drained %d uploads in %s", pending, time.Since(start).String())
+	case <-time.After(timeout):
+		abandoned := s.uploads.running()
+		log.Printf("shutdown: drain timed out, drained=%d abandoned=%d", pending-abandoned, abandoned)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), max(timeout-time.Since(start), time.Second))
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: http server did not stop cleanly: %v", err)
+	}
+}
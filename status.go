@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// registrationStatuses are the values registration.status may take; new rows
+// start as "pending".
+var registrationStatuses = []string{"pending", "processing", "approved", "rejected", "cancelled"}
+
+// statusTransitions lists the statuses each status may move to. approved,
+// rejected and cancelled are final.
+var statusTransitions = map[string][]string{
+	"pending":    {"processing", "cancelled"},
+	"processing": {"approved", "rejected", "cancelled"},
+}
+
+// checkStatusTransition returns "" when a registration in status from may be
+// set to to, otherwise the reason reported to the client. Setting a
+// registration to the status it already has is allowed and changes nothing.
+func checkStatusTransition(from, to string) string {
+	if from == to || slices.Contains(statusTransitions[from], to) {
+		return ""
+	}
+	return "invalid_transition"
+}
+
+type bulkStatusRequest struct {
+	IDs    []string `json:"ids"`
+	Status string   `json:"status"`
+}
+
+// statusUpdateResult is the outcome for one requested id.
+type statusUpdateResult struct {
+	ID      string `json:"id"`
+	Success bool   `json:"success"`
+	From    string `json:"from,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// bulkUpdateStatusHandler moves many registrations to one status in a single
+// transaction. Each id is validated on its own, so rejected ids are reported
+// alongside the ones that were applied instead of failing the batch. Like
+// single updates, these are agent writes and need the API key.
+func (s *server) bulkUpdateStatusHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("bulkUpdateStatus start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST, OPTIONS")
+		return
+	}
+	if !s.requireAPIKey(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var req bulkStatusRequest
+	if !decodeJSONBody(w, r, "bulkUpdateStatus", &req) {
+		return
+	}
+
+	req.Status = strings.ToLower(strings.TrimSpace(req.Status))
+	if !slices.Contains(registrationStatuses, req.Status) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "invalid_status", "allowed": registrationStatuses})
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "empty_batch"})
+		return
+	}
+
+	if len(req.IDs) > s.cfg.BulkRegistrationMax {
+		log.Printf("bulkUpdateStatus batch too large: %d", len(req.IDs))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "batch_too_large", "max": s.cfg.BulkRegistrationMax})
+		return
+	}
+
+	results := make([]statusUpdateResult, len(req.IDs))
+	ids := make([]uuid.UUID, 0, len(req.IDs))
+	seen := make(map[uuid.UUID]bool, len(req.IDs))
+	for i, raw := range req.IDs {
+		results[i].ID = raw
+		id, err := uuid.Parse(strings.TrimSpace(raw))
+		switch {
+		case err != nil:
+			results[i].Error = "invalid_registration_id"
+		case seen[id]:
+			results[i].Error = "duplicate_id"
+		default:
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	outcomes, err := s.updateRegistrationStatuses(ctx, ids, req.Status, w.Header().Get("X-Request-ID"))
+	if err != nil {
+		writeServerError(w, r, "bulkUpdateStatus update", err)
+		return
+	}
+
+	for i := range results {
+		if results[i].Error != "" {
+			continue
+		}
+		id, _ := uuid.Parse(strings.TrimSpace(results[i].ID))
+		o := outcomes[id]
+		results[i].From = o.from
+		switch {
+		case !o.found:
+			results[i].Error = "registration_not_found"
+		case o.reason != "":
+			results[i].Error = o.reason
+		default:
+			results[i].Success = true
+			results[i].Status = req.Status
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]any{"results": results}); err != nil {
+		log.Printf("bulkUpdateStatus encode failed: %v", err)
+	}
+}
+
+// registrationTimelineHandler serves GET /registrations/{id}/timeline: the
+// registration's current status and its status changes, oldest first.
+func (s *server) registrationTimelineHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("registrationTimeline start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, "GET, OPTIONS")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	registration, err := s.getRegistrationByID(ctx, registrationID)
+	if err != nil {
+		if errors.Is(err, errRegistrationNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+			return
+		}
+		writeServerError(w, r, "registrationTimeline fetch", err)
+		return
+	}
+
+	transitions, err := s.getRegistrationTimeline(ctx, registrationID)
+	if err != nil {
+		writeServerError(w, r, "registrationTimeline query", err)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]any{
+		"registration_id": registrationID,
+		"status":          registration.Status,
+		"created_at":      registration.CreatedAt,
+		"transitions":     transitions,
+	}); err != nil {
+		log.Printf("registrationTimeline encode failed: %v", err)
+	}
+}
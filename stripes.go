@@ -0,0 +1,18 @@
+package main
+
+import "sync"
+
+// stripedMutex serializes work per key with a fixed set of mutexes, so memory
+// stays bounded however many keys are seen. Distinct keys may share a stripe
+// and occasionally wait on each other; equal keys always do. The zero value is
+// ready to use.
+type stripedMutex struct {
+	stripes [64]sync.Mutex
+}
+
+// lock acquires the stripe for key and returns its unlock func.
+func (m *stripedMutex) lock(key uint64) func() {
+	mu := &m.stripes[key%uint64(len(m.stripes))]
+	mu.Lock()
+	return mu.Unlock
+}
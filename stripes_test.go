@@ -0,0 +1,28 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStripedMutexSerializesEqualKeys(t *testing.T) {
+	var (
+		m       stripedMutex
+		holders atomic.Int32
+		wg      sync.WaitGroup
+	)
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := m.lock(42)
+			defer unlock()
+			if n := holders.Add(1); n != 1 {
+				t.Errorf("%d goroutines hold the lock for one key", n)
+			}
+			holders.Add(-1)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errUpdateInvalid aborts an update whose merged request fails validation.
+var errUpdateInvalid = errors.New("registration update failed validation")
+
+// maxUpdateBodySize caps a PATCH body, which is read whole before decoding.
+const maxUpdateBodySize = 1 << 20 // 1MB
+
+// registrationETag is a strong validator for a registration. updated_at is
+// bumped by every write, and Postgres stores it to the microsecond.
+func registrationETag(r Registration) string {
+	return `"` + strconv.FormatInt(r.UpdatedAt.UnixMicro(), 36) + `"`
+}
+
+// setRegistrationValidators sets the ETag and Last-Modified headers clients
+// send back in If-Match and If-Unmodified-Since.
+func setRegistrationValidators(w http.ResponseWriter, r Registration) {
+	w.Header().Set("ETag", registrationETag(r))
+	w.Header().Set("Last-Modified", r.UpdatedAt.UTC().Format(http.TimeFormat))
+}
+
+// updatePrecondition is the If-Match / If-Unmodified-Since state of a request.
+type updatePrecondition struct {
+	ifMatch         string
+	unmodifiedSince time.Time
+}
+
+// parseUpdatePrecondition reads the conditional headers. An unparseable
+// If-Unmodified-Since is ignored, as RFC 9110 requires.
+func parseUpdatePrecondition(r *http.Request) updatePrecondition {
+	p := updatePrecondition{ifMatch: strings.TrimSpace(r.Header.Get("If-Match"))}
+	if v := r.Header.Get("If-Unmodified-Since"); v != "" {
+		if t, err := http.ParseTime(v); err == nil {
+			p.unmodifiedSince = t
+		}
+	}
+	return p
+}
+
+// holds reports whether current still matches what the client last saw.
+// If-Match wins over If-Unmodified-Since when both are sent; weak tags never
+// match because If-Match uses strong comparison.
+func (p updatePrecondition) holds(current Registration) bool {
+	if p.ifMatch != "" {
+		if p.ifMatch == "*" {
+			return true
+		}
+		etag := registrationETag(current)
+		for _, tag := range strings.Split(p.ifMatch, ",") {
+			if strings.TrimSpace(tag) == etag {
+				return true
+			}
+		}
+		return false
+	}
+	if !p.unmodifiedSince.IsZero() {
+		// HTTP dates have one second resolution
+		return !current.UpdatedAt.Truncate(time.Second).After(p.unmodifiedSince)
+	}
+	return true
+}
+
+// registrationRequest returns the editable fields of r as a create request,
+// the starting point PATCH merges the body into.
+func registrationRequest(r Registration) createRegistrationRequest {
+	applicantCount := r.ApplicantCount
+	return createRegistrationRequest{
+		FullName:       r.FullName,
+		JobTitle:       r.JobTitle,
+		AddressFull:    r.AddressFull,
+		WhatsappNumber: r.WhatsappNumber,
+		Note:           r.Note,
+		ApplicantCount: &applicantCount,
+		VisaType:       r.VisaType,
+	}
+}
+
+// updateRegistrationHandler serves PUT (replace every editable field) and
+// PATCH (change only the fields present in the body; null clears an optional
+// one) on a registration. The If-Match or If-Unmodified-Since precondition is
+// checked against the locked row, so a write that raced the client's read is
+// rejected with 412 instead of being silently overwritten. Updates are agent
+// writes and need the API key.
+func (s *server) updateRegistrationHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("updateRegistration start: registrationID=%s method=%s remote=%s", registrationID.String(), r.Method, r.RemoteAddr)
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		writeMethodNotAllowed(w, "GET, PUT, PATCH, OPTIONS")
+		return
+	}
+	if !s.requireAPIKey(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	cond := parseUpdatePrecondition(r)
+
+	var (
+		replacement createRegistrationRequest
+		patch       []byte
+	)
+	if r.Method == http.MethodPatch {
+		// keep the raw body: merging it over the current row tells absent
+		// fields apart from ones set to null
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUpdateBodySize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				log.Printf("updateRegistration body too large: limit %d", maxErr.Limit)
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				_ = json.NewEncoder(w).Encode(map[string]any{"error": "body_too_large", "max_bytes": maxErr.Limit})
+				return
+			}
+			writeDecodeError(w, "updateRegistration", err)
+			return
+		}
+		patch = body
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if !decodeJSONBody(w, r, "updateRegistration", &replacement) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	var (
+		current Registration
+		errs    validationErrors
+	)
+	registration, err := s.updateRegistration(ctx, registrationID, func(c Registration) (createRegistrationRequest, error) {
+		current = c
+		if !cond.holds(c) {
+			return createRegistrationRequest{}, errPreconditionFailed
+		}
+
+		req := replacement
+		if patch != nil {
+			req = registrationRequest(c)
+			if err := json.Unmarshal(patch, &req); err != nil {
+				return createRegistrationRequest{}, err
+			}
+		}
+		if errs = s.validateRegistrationRequest(&req); errs != nil {
+			return createRegistrationRequest{}, errUpdateInvalid
+		}
+		return req, nil
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, errRegistrationNotFound):
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+		case errors.Is(err, errPreconditionFailed):
+			log.Printf("updateRegistration precondition failed: registrationID=%s", registrationID.String())
+			setRegistrationValidators(w, current)
+			w.WriteHeader(http.StatusPreconditionFailed)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "precondition_failed"})
+		case errors.Is(err, errRegistrationLimitReached):
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "registration_limit_reached", "limit": s.cfg.MaxRegistrationsPerWhatsapp})
+		case errors.Is(err, errUpdateInvalid):
+			logValidationRejections("updateRegistration", errs)
+			writeValidationErrors(w, errs)
+		default:
+			writeServerError(w, r, "updateRegistration update", err)
+		}
+		return
+	}
+
+	setRegistrationValidators(w, registration)
+	if err := json.NewEncoder(w).Encode(registration); err != nil {
+		log.Printf("updateRegistration encode failed: %v", err)
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Resumable uploads follow the shape of tus: POST /uploads opens a session
+// for a known length, PATCH /uploads/{id} appends a chunk at Upload-Offset,
+// HEAD /uploads/{id} tells a reconnecting client where to resume, and
+// POST /uploads/{id}/finalize stores the assembled bytes exactly as the
+// multipart upload endpoints would. Sessions idle for UPLOAD_SESSION_TTL are
+// discarded.
+
+type createUploadRequest struct {
+	Target         string  `json:"target"`
+	RegistrationID *string `json:"registration_id"`
+	UserID         *int64  `json:"user_id"`
+	FileType       *string `json:"file_type"`
+	Filename       string  `json:"filename"`
+	Length         *int64  `json:"length"`
+}
+
+// uploadCutoff is the updated_at before which a session counts as expired.
+func (s *server) uploadCutoff() time.Time {
+	if s.cfg.UploadSessionTTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-s.cfg.UploadSessionTTL)
+}
+
+func setUploadHeaders(w http.ResponseWriter, u uploadSession) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func (s *server) uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("createUpload start: method=%s remote=%s", r.Method, r.RemoteAddr)
+	if r.Method == http.MethodOptions {
+		writeOptions(w, "POST, OPTIONS")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, "POST, OPTIONS")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
+	}
+
+	var req createUploadRequest
+	if !decodeJSONBody(w, r, "createUpload", &req) {
+		return
+	}
+
+	if req.Length == nil {
+		if v := r.Header.Get("Upload-Length"); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				req.Length = &n
+			}
+		}
+	}
+	if req.Length == nil || *req.Length <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_upload_length"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	sess := uploadSession{
+		Target:   strings.ToLower(strings.TrimSpace(req.Target)),
+		Filename: strings.TrimSpace(req.Filename),
+		Length:   *req.Length,
+	}
+
+	var limit int64
+	switch sess.Target {
+	case uploadTargetRegistrationFile:
+		if req.RegistrationID == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_id_required"})
+			return
+		}
+		regID, err := uuid.Parse(strings.TrimSpace(*req.RegistrationID))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_registration_id"})
+			return
+		}
+		if req.FileType == nil || strings.TrimSpace(*req.FileType) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "file_type_required"})
+			return
+		}
+		if _, err := s.getRegistrationByID(ctx, regID); err != nil {
+			if errors.Is(err, errRegistrationNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+				return
+			}
+			writeServerError(w, r, "createUpload registration", err)
+			return
+		}
+		fileType := normalizeFileType(*req.FileType)
+		sess.RegistrationID = &regID
+		sess.FileType = &fileType
+		limit = maxUploadSize
+
+	case uploadTargetCV:
+		if req.UserID == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_id_required"})
+			return
+		}
+		var err error
+		if limit, err = s.cvUploadLimit(ctx, *req.UserID); err != nil {
+			if errors.Is(err, errUserNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				_ = json.NewEncoder(w).Encode(map[string]string{"error": "user_not_found"})
+				return
+			}
+			writeServerError(w, r, "createUpload limit", err)
+			return
+		}
+		sess.UserID = req.UserID
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":   "invalid_target",
+			"allowed": []string{uploadTargetRegistrationFile, uploadTargetCV},
+		})
+		return
+	}
+
+	if sess.Length > limit {
+		log.Printf("createUpload file too large: %d bytes", sess.Length)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "file_too_large", "limit_bytes": limit})
+		return
+	}
+
+	sess, err := s.createUploadSession(ctx, sess)
+	if err != nil {
+		writeServerError(w, r, "createUpload insert", err)
+		return
+	}
+
+	setUploadHeaders(w, sess)
+	w.Header().Set("Location", s.publicURL(r, "/uploads/"+sess.UploadID.String()))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(sess); err != nil {
+		log.Printf("createUpload encode failed: %v", err)
+	}
+}
+
+func (s *server) uploadSessionHandler(w http.ResponseWriter, r *http.Request) {
+	parts, ok := routeSegments(w, r, 3)
+	if !ok {
+		return
+	}
+	if len(parts) < 2 || parts[0] != "uploads" {
+		notFoundHandler(w, r)
+		return
+	}
+
+	uploadID, err := uuid.Parse(parts[1])
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_upload_id"})
+		return
+	}
+
+	if len(parts) == 3 {
+		if parts[2] != "finalize" {
+			writeUnknownSubresource(w, r, parts[2], []string{"finalize"})
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			s.finalizeUploadHandler(w, r, uploadID)
+		case http.MethodOptions:
+			writeOptions(w, "POST, OPTIONS")
+		default:
+			writeMethodNotAllowed(w, "POST, OPTIONS")
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		s.getUploadHandler(w, r, uploadID)
+	case http.MethodPatch:
+		s.appendUploadHandler(w, r, uploadID)
+	case http.MethodDelete:
+		s.deleteUploadHandler(w, r, uploadID)
+	case http.MethodOptions:
+		writeOptions(w, "GET, HEAD, PATCH, DELETE, OPTIONS")
+	default:
+		writeMethodNotAllowed(w, "GET, HEAD, PATCH, DELETE, OPTIONS")
+	}
+}
+
+// loadUploadSession fetches the session or writes the 404 for a missing or
+// expired one.
+func (s *server) loadUploadSession(ctx context.Context, w http.ResponseWriter, r *http.Request, op string, uploadID uuid.UUID) (uploadSession, bool) {
+	sess, err := s.getUploadSession(ctx, uploadID, s.uploadCutoff())
+	if err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "upload_not_found"})
+			return uploadSession{}, false
+		}
+		writeServerError(w, r, op+" fetch", err)
+		return uploadSession{}, false
+	}
+	return sess, true
+}
+
+// getUploadHandler reports progress; HEAD carries it in Upload-Offset alone,
+// which is all a client needs to resume.
+func (s *server) getUploadHandler(w http.ResponseWriter, r *http.Request, uploadID uuid.UUID) {
+	log.Printf("getUpload start: uploadID=%s method=%s remote=%s", uploadID.String(), r.Method, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	sess, ok := s.loadUploadSession(ctx, w, r, "getUpload", uploadID)
+	if !ok {
+		return
+	}
+
+	setUploadHeaders(w, sess)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(sess); err != nil {
+		log.Printf("getUpload encode failed: %v", err)
+	}
+}
+
+// appendUploadHandler appends the request body at Upload-Offset. A stale
+// offset gets 409 with the server's offset so the client can resume from it.
+func (s *server) appendUploadHandler(w http.ResponseWriter, r *http.Request, uploadID uuid.UUID) {
+	log.Printf("appendUpload start: uploadID=%s method=%s remote=%s", uploadID.String(), r.Method, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_upload_offset"})
+		return
+	}
+
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	sess, ok := s.loadUploadSession(ctx, w, r, "appendUpload", uploadID)
+	cancel()
+	if !ok {
+		return
+	}
+
+	if offset != sess.Offset {
+		setUploadHeaders(w, sess)
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "offset_mismatch", "offset": sess.Offset})
+		return
+	}
+
+	// reading one byte past what's left detects a chunk that overruns the
+	// declared length without buffering the overrun
+	remaining := sess.Length - sess.Offset
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, remaining+1))
+	if err != nil {
+		log.Printf("appendUpload read failed: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_body"})
+		return
+	}
+	if int64(len(chunk)) > remaining {
+		setUploadHeaders(w, sess)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "chunk_exceeds_length", "remaining_bytes": remaining})
+		return
+	}
+
+	ctx, cancel = context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	newOffset, err := s.appendUploadChunk(ctx, uploadID, offset, chunk)
+	if err != nil {
+		if errors.Is(err, errUploadOffsetMismatch) {
+			// another request moved the offset (or removed the session)
+			// between our read and the update
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "offset_mismatch"})
+			return
+		}
+		writeServerError(w, r, "appendUpload update", err)
+		return
+	}
+
+	sess.Offset = newOffset
+	setUploadHeaders(w, sess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finalizeUploadHandler hands the assembled bytes to the same storage path as
+// a multipart upload and drops the session once they are saved. A rejected
+// file leaves the session in place so the response can be inspected, and it
+// expires like any other.
+func (s *server) finalizeUploadHandler(w http.ResponseWriter, r *http.Request, uploadID uuid.UUID) {
+	log.Printf("finalizeUpload start: uploadID=%s method=%s remote=%s", uploadID.String(), r.Method, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if !s.requireUploadOrigin(w, r) {
+		return
+	}
+
+	release, ok := s.acquireUploadSlot(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	sess, ok := s.loadUploadSession(ctx, w, r, "finalizeUpload", uploadID)
+	if !ok {
+		return
+	}
+
+	if sess.Offset != sess.Length {
+		setUploadHeaders(w, sess)
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "upload_incomplete", "offset": sess.Offset, "length": sess.Length})
+		return
+	}
+
+	data, err := s.claimUploadSession(ctx, uploadID)
+	if err != nil {
+		if errors.Is(err, errUploadClaimed) {
+			w.WriteHeader(http.StatusConflict)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "upload_already_finalizing"})
+			return
+		}
+		writeServerError(w, r, "finalizeUpload claim", err)
+		return
+	}
+
+	var stored bool
+	switch {
+	case sess.Target == uploadTargetRegistrationFile && sess.RegistrationID != nil && sess.FileType != nil:
+		stored = s.storeRegistrationFile(w, r, "finalizeUpload", *sess.RegistrationID, *sess.FileType, sess.Filename, data)
+	case sess.Target == uploadTargetCV && sess.UserID != nil:
+		stored = s.storeUserCV(w, r, "finalizeUpload", *sess.UserID, sess.Filename, "", data, false)
+	default:
+		writeServerError(w, r, "finalizeUpload target", errors.New("session has no usable target: "+sess.Target))
+	}
+	if !stored {
+		// released even if the client hung up, or the session stays stuck
+		releaseCtx, cancelRelease := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancelRelease()
+		if err := s.releaseUploadSession(releaseCtx, uploadID); err != nil {
+			log.Printf("finalizeUpload: could not release session %s: %v", uploadID.String(), err)
+		}
+		return
+	}
+
+	if err := s.deleteUploadSession(ctx, uploadID); err != nil {
+		log.Printf("finalizeUpload: stored upload but could not delete session %s: %v", uploadID.String(), err)
+	}
+}
+
+func (s *server) deleteUploadHandler(w http.ResponseWriter, r *http.Request, uploadID uuid.UUID) {
+	log.Printf("deleteUpload start: uploadID=%s method=%s remote=%s", uploadID.String(), r.Method, r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	if err := s.deleteUploadSession(ctx, uploadID); err != nil {
+		if errors.Is(err, errUploadNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "upload_not_found"})
+			return
+		}
+		writeServerError(w, r, "deleteUpload", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// webhookMaxBackoff caps the exponential wait between delivery attempts.
+const webhookMaxBackoff = 30 * time.Second
+
+// webhookQueueSize bounds events waiting for delivery; when it is full new
+// events are dead-lettered rather than blocking the request that raised them.
+const webhookQueueSize = 256
+
+type webhookEvent struct {
+	Event  string    `json:"event"`
+	SentAt time.Time `json:"sent_at"`
+	Data   any       `json:"data"`
+}
+
+// webhookNotifier POSTs registration events to WEBHOOK_URL from a background
+// worker, so a slow or unreachable receiver never adds latency to the API.
+// Each attempt has its own timeout; failures are retried with capped
+// exponential backoff and, once attempts run out, the event is written to the
+// log as a dead letter. A nil *webhookNotifier is valid and sends nothing.
+type webhookNotifier struct {
+	url      string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+	queue    chan webhookEvent
+}
+
+func newWebhookNotifier(url string, timeout time.Duration, attempts int, backoff time.Duration) *webhookNotifier {
+	if url == "" {
+		return nil
+	}
+	return &webhookNotifier{
+		url:      url,
+		client:   &http.Client{Timeout: timeout},
+		attempts: max(attempts, 1),
+		backoff:  backoff,
+		queue:    make(chan webhookEvent, webhookQueueSize),
+	}
+}
+
+func newWebhookEvent(event string, data any) webhookEvent {
+	return webhookEvent{Event: event, SentAt: time.Now().UTC(), Data: data}
+}
+
+// notify queues an event without blocking.
+func (n *webhookNotifier) notify(event string, data any) {
+	if n == nil {
+		return
+	}
+	ev := newWebhookEvent(event, data)
+	select {
+	case n.queue <- ev:
+	default:
+		n.deadLetter(ev, 0, fmt.Errorf("delivery queue full (%d events)", webhookQueueSize))
+	}
+}
+
+// run delivers queued events one at a time until ctx is done.
+func (n *webhookNotifier) run(ctx context.Context) {
+	if n == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.queue:
+			n.deliver(ctx, ev)
+		}
+	}
+}
+
+func (n *webhookNotifier) deliver(ctx context.Context, ev webhookEvent) {
+	var err error
+	wait := n.backoff
+	for attempt := 1; ; attempt++ {
+		err = n.send(ctx, ev)
+		if err == nil {
+			log.Printf("webhook: delivered event=%s attempt=%d", ev.Event, attempt)
+			return
+		}
+		if attempt >= n.attempts {
+			break
+		}
+		log.Printf("webhook: event=%s attempt=%d failed, retrying in %s: %v", ev.Event, attempt, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			n.deadLetter(ev, attempt, ctx.Err())
+			return
+		}
+		wait = min(wait*2, webhookMaxBackoff)
+	}
+	n.deadLetter(ev, n.attempts, err)
+}
+
+// send makes a single delivery attempt.
+func (n *webhookNotifier) send(ctx context.Context, ev webhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// deadLetter logs an undeliverable event with its full payload so it can be
+// replayed by hand, and counts it.
+func (n *webhookNotifier) deadLetter(ev webhookEvent, attempts int, lastErr error) {
+	webhookDeliveryFailures.WithLabelValues(ev.Event).Inc()
+
+	line, err := json.Marshal(map[string]any{
+		"msg":        "webhook dead letter",
+		"event":      ev.Event,
+		"attempts":   attempts,
+		"last_error": lastErr.Error(),
+		"payload":    ev,
+	})
+	if err != nil {
+		log.Printf("webhook dead letter: event=%s attempts=%d last_error=%v (payload not encodable: %v)", ev.Event, attempts, lastErr, err)
+		return
+	}
+	log.Println(string(line))
+}
+
+// notifyRegistrationHandler serves POST /registrations/{id}/notify: it re-sends
+// the registration.created event for an existing registration, e.g. for ones
+// created while the receiver was down. Unlike automatic delivery it makes one
+// attempt inline and reports the outcome, leaving retries to the operator.
+func (s *server) notifyRegistrationHandler(w http.ResponseWriter, r *http.Request, registrationID uuid.UUID) {
+	log.Printf("notifyRegistration start: registrationID=%s remote=%s", registrationID.String(), r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json")
+
+	if s.webhook == nil {
+		w.WriteHeader(http.StatusConflict)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "webhook_not_configured"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	registration, err := s.getRegistrationByID(ctx, registrationID)
+	cancel()
+	if err != nil {
+		if errors.Is(err, errRegistrationNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "registration_not_found"})
+			return
+		}
+		writeServerError(w, r, "notifyRegistration fetch", err)
+		return
+	}
+
+	ev := newWebhookEvent("registration.created", registration)
+	if err := s.webhook.send(r.Context(), ev); err != nil {
+		log.Printf("notifyRegistration: delivery failed registrationID=%s: %v", registrationID.String(), err)
+		webhookDeliveryFailures.WithLabelValues(ev.Event).Inc()
+		w.WriteHeader(http.StatusBadGateway)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"error":           "webhook_delivery_failed",
+			"registration_id": registrationID,
+			"event":           ev.Event,
+			"detail":          err.Error(),
+		})
+		return
+	}
+
+	log.Printf("notifyRegistration: delivered registrationID=%s", registrationID.String())
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"status":          "delivered",
+		"registration_id": registrationID,
+		"event":           ev.Event,
+		"sent_at":         ev.SentAt,
+	})
+}